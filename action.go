@@ -60,7 +60,9 @@ func (a *action) Execute(l logLine) error {
 
 func (a *action) formatCmdTpl(l logLine) (string, []string, error) {
 	params := cmdParams{
-		"ip": l.IP().String(),
+		"ip":        l.IP().String(),
+		sourceField: l.Source(),
+		cidrField:   hostCIDR(l.IP()),
 	}
 
 	l.EachField(func(k, v string) {
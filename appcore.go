@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
-	"io"
-	"net"
-	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,8 +13,12 @@ import (
 const (
 	cacheWriteTimeFormat = time.RFC3339
 	saveInterval         = time.Minute
+	actionQueueSize      = 1024
+	shutdownTimeout      = time.Second * 10
 )
 
+var errShutdownTimeout = errors.New("shutdown timeout")
+
 type hitCounter func(name string)
 
 type executionTimeMeasure func(seconds float64)
@@ -24,194 +26,347 @@ type executionTimeMeasure func(seconds float64)
 type appcore struct {
 	hit              hitCounter
 	executionMeasure executionTimeMeasure
+	latencyMeasure   executionTimeMeasure
 
 	passCache  *ipCache
 	blockCache *ipCache
-
-	streamer *logStreamer
-	c        *chain
-	act      *action
-	log      *logPrinter
+	// prefix lengths of subnets in blockCache
+	subnets *subnetIndex
+	bans    *banLedger
+
+	streamer lineSource
+
+	// pipeline is replaced on config reload
+	mu *sync.RWMutex
+	p  *pipeline
+
+	// lines waiting for block action
+	actions chan blockJob
+	// closed when all queued actions are executed
+	actionsDone chan struct{}
+	// closed when log stream is over
+	stop chan struct{}
 }
 
-type ipCache struct {
-	path string
-	mu   *sync.RWMutex
-	data map[string]struct {
-		added time.Time
-	}
+// blockJob line waiting for block action, action is taken from pipeline
+// which made decision, so executor never wait for reload
+type blockJob struct {
+	l   logLine
+	act *action
 }
 
-func newAppCore(streamer *logStreamer, c *chain, act *action, lp *logPrinter, cachepath string, hit hitCounter, executionMeasure executionTimeMeasure) *appcore {
-	passCache, err := newIPCaheFromFile(cachepath)
+func newAppCore(streamer lineSource, p *pipeline, cacheCfg ipCacheConfig, bans *banLedger, hit hitCounter, executionMeasure executionTimeMeasure, latencyMeasure executionTimeMeasure) *appcore {
+	passCache, err := newIPCaheFromFile(cacheCfg)
 	if err != nil {
-		log.Printf("cannot load cache file %s: %v", cachepath, err)
-		passCache = newIPCache(cachepath)
+		log.Printf("cannot load cache file %s: %v", cacheCfg.path, err)
+		passCache = newIPCache(cacheCfg)
+	}
+
+	// IPs banned before restart should not be acted on again
+	blockCache := newIPCache(ipCacheConfig{})
+	subnets := newSubnetIndex()
+
+	for _, target := range bans.Active() {
+		blockCache.addKey(target, noSourceMark)
+		subnets.add(target)
 	}
 
 	return &appcore{
 		executionMeasure: executionMeasure,
+		latencyMeasure:   latencyMeasure,
 		hit:              hit,
 		passCache:        passCache,
-		blockCache:       newIPCache(""),
+		blockCache:       blockCache,
+		subnets:          subnets,
+		bans:             bans,
 
 		streamer: streamer,
-		c:        c,
-		act:      act,
-		log:      lp,
+		mu:       &sync.RWMutex{},
+		p:        p,
+
+		actions:     make(chan blockJob, actionQueueSize),
+		actionsDone: make(chan struct{}),
+		stop:        make(chan struct{}),
 	}
 }
 
-// TODO: replace string with function that return writer
-func newIPCache(path string) *ipCache {
-	return &ipCache{
-		path: path,
-		mu:   &sync.RWMutex{},
-		data: map[string]struct {
-			added time.Time
-		}{},
+// run process lines until stream is over, then wait queued actions and
+// save caches
+func (core *appcore) run() error {
+	go core.passCache.saver(core.stop)
+	go core.bans.saver(core.stop)
+	go core.unbanner()
+	go core.executor()
+
+	lines := core.streamer.C()
+
+	for {
+		var l *logLine
+		var ok bool
+
+		select {
+		case l, ok = <-lines:
+		case l = <-core.current().c.Rechecks():
+			// asynchronous checker made decision about line
+			core.recheck(l)
+			continue
+		}
+
+		if !ok {
+			break
+		}
+
+		core.process(l)
+
+		if !l.writtenAt.IsZero() {
+			core.latencyMeasure(time.Since(l.writtenAt).Seconds())
+		}
+	}
+
+	streamErr := core.streamer.Err()
+	if streamErr != nil {
+		streamErr = fmt.Errorf("log stream: %w", streamErr)
 	}
+
+	return firstErr(streamErr, core.shutdown(shutdownTimeout))
 }
 
-func newIPCaheFromFile(path string) (*ipCache, error) {
-	if path == "" {
-		return newIPCache(path), nil
+// shutdown wait queued block actions and save caches
+func (core *appcore) shutdown(timeout time.Duration) error {
+	close(core.stop)
+	close(core.actions)
+
+	var err error
+
+	log.Printf("waiting for %d queued actions", len(core.actions))
+
+	select {
+	case <-core.actionsDone:
+	case <-time.After(timeout):
+		err = fmt.Errorf("%w: %d actions are not executed", errShutdownTimeout, len(core.actions))
 	}
 
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
-	if err != nil {
-		return nil, fmt.Errorf("cannot open cache file %q: %w", path, err)
+	count, saveErr := core.passCache.Save()
+	if saveErr != nil {
+		err = firstErr(err, fmt.Errorf("cannot save cache: %w", saveErr))
+	} else if count > 0 {
+		log.Printf("cache saved %d records", count)
 	}
 
-	scanner := bufio.NewScanner(f)
+	count, saveErr = core.bans.Save()
+	if saveErr != nil {
+		err = firstErr(err, fmt.Errorf("cannot save ban ledger: %w", saveErr))
+	} else if count > 0 {
+		log.Printf("ban ledger saved %d records", count)
+	}
 
-	cache := newIPCache(path)
+	// checkers save own caches on close
+	closeErr := core.current().Close()
+	if closeErr != nil {
+		err = firstErr(err, closeErr)
+	}
 
-	for scanner.Scan() {
-		str := scanner.Text()
+	return err
+}
 
-		var strIP, strTime string
+// current return pipeline used for new lines
+func (core *appcore) current() *pipeline {
+	core.mu.RLock()
+	defer core.mu.RUnlock()
 
-		_, err := fmt.Sscanf(str, "%s %s", &strIP, &strTime)
-		if err != nil {
-			return nil, fmt.Errorf("cannot parse cache line %q: %w", str, err)
-		}
+	return core.p
+}
 
-		t, err := time.Parse(cacheWriteTimeFormat, strTime)
-		if err != nil {
-			return nil, fmt.Errorf("cannot parse time %q: %w", strTime, err)
-		}
+// swap replace pipeline after lines in progress are processed, old
+// pipeline is returned
+func (core *appcore) swap(p *pipeline) *pipeline {
+	core.mu.Lock()
+	defer core.mu.Unlock()
 
-		ip := net.ParseIP(strIP)
+	old := core.p
+	core.p = p
 
-		cache.addWithTime(ip, t)
-	}
+	return old
+}
 
-	if scanner.Err() != nil {
-		return nil, fmt.Errorf("cannot read cache: %w", scanner.Err())
-	}
+func (core *appcore) process(l *logLine) {
+	core.hit("total")
+	core.decide(l, false)
+}
+
+// recheck decide again line held or passed by asynchronous checker
+func (core *appcore) recheck(l *logLine) {
+	core.hit("recheck")
+	core.decide(l, true)
+}
 
-	log.Printf("%d records loaded from cache %s", len(cache.data), path)
+func (core *appcore) decide(l *logLine, recheck bool) {
+	job, ok := core.judge(l, recheck)
+	if !ok {
+		return
+	}
 
-	return cache, nil
+	// lock is not held here, full queue must not block reload
+	core.actions <- job
 }
 
-func (core *appcore) run() error {
-	go core.passCache.saver()
+// judge decide line with current pipeline and return block job if IP
+// should be banned, rechecked line continue from position of asynchronous
+// checker
+func (core *appcore) judge(l *logLine, recheck bool) (blockJob, bool) {
+	// pipeline can't be closed by reload while line is processed
+	core.mu.RLock()
+	defer core.mu.RUnlock()
+
+	ip := l.IP()
+
+	// line is not matched by log format, there is nothing to ban
+	if ip == nil {
+		core.hit("no_ip")
+		log.Debugf("line without IP is skipped: %s", l.String())
+		return blockJob{}, false
+	}
 
-	for l := range core.streamer.C() {
-		// ip := l.IP()
+	if source, ok := core.passCache.Lookup(ip); ok {
+		core.hit("whitelist")
+		log.Debugf("%s in whitelist (%s)", ip.String(), source)
+		return blockJob{}, false
+	}
 
-		core.hit("total")
+	core.hit("whitelist_miss")
 
-		// if core.passCache.Contains(ip) {
-		// 	core.hit("whitelist")
-		// 	log.Debugf("%s in whitelist", ip.String())
-		// 	continue
-		// }
+	// IP already banned or waiting for block action
+	if core.blockCache.Contains(ip) {
+		core.hit("blocklist")
+		log.Debugf("%s in blocklist", ip.String())
+		return blockJob{}, false
+	}
 
-		// if core.blockCache.Contains(ip) {
-		// 	core.hit("blocklist")
-		// 	log.Debugf("%s in blocklist", ip.String())
-		// 	continue
-		// }
+	// IP of banned subnet is not checked at all
+	if subnet, ok := core.subnets.lookup(ip, core.blockCache.containsKey); ok {
+		core.hit("blocklist")
+		log.Debugf("%s subnet %s in blocklist", ip.String(), subnet)
+		return blockJob{}, false
+	}
 
-		if core.c.NeedBan(l) {
-			//core.blockCache.Add(ip)
+	var decision instantDecision
 
-			core.log.Println(*l)
+	if recheck {
+		var ok bool
 
-			startedAt := time.Now()
-			err := core.act.Execute(*l)
-			if err != nil {
-				log.Printf("cannot execute action: %v", err)
-			}
-			core.executionMeasure(time.Since(startedAt).Seconds())
-			continue
+		decision, ok = core.p.c.Recheck(l)
+		if !ok {
+			rechecksAbandonedCounter.Inc()
+			log.Debugf("%s recheck is abandoned, checker is replaced by reload", ip.String())
+			return blockJob{}, false
 		}
+	} else {
+		decision = core.p.c.Decide(l)
+	}
 
-		//core.passCache.Add(ip)
+	if decision == decisionHold {
+		core.hit("hold")
+		log.Debugf("%s is held until decision of %s", ip.String(), l.fields[checkerField])
+		return blockJob{}, false
 	}
 
-	return core.streamer.Err()
-}
+	if decision == decisionBan {
+		target := banTarget(l)
 
-func (c *ipCache) Contains(ip net.IP) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+		// other IP of already banned subnet
+		if core.blockCache.containsKey(target) {
+			core.hit("blocklist")
+			duplicateBlocksCounter.Inc()
+			log.Debugf("%s subnet %s in blocklist", ip.String(), target)
+			return blockJob{}, false
+		}
 
-	_, ok := c.data[ip.String()]
+		core.blockCache.addKey(target, noSourceMark)
+		core.subnets.add(target)
 
-	return ok
-}
+		ban := core.bans.BanTarget(target)
+		l.Set(banCountField, strconv.Itoa(ban.count))
+		l.Set(banDurationField, ban.Duration())
 
-func (c *ipCache) Add(ip net.IP) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+		core.p.log.Println(*l)
 
-	c.addWithTime(ip, time.Now())
-}
+		return blockJob{l: *l, act: core.p.act}, true
+	}
 
-func (c *ipCache) addWithTime(ip net.IP, t time.Time) {
-	c.data[ip.String()] = struct{ added time.Time }{added: t}
+	// cache only explicit whitelist decision, score can change with next lines
+	if source, _ := l.Get(checkerField); source != scoreCheckerName {
+		core.passCache.AddSource(ip, source)
+	}
+
+	return blockJob{}, false
 }
 
-func (c *ipCache) writeTo(w io.Writer) (int, error) {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// executor execute block action for queued lines one by one
+func (core *appcore) executor() {
+	defer close(core.actionsDone)
 
-	for ip, stat := range c.data {
-		_, err := fmt.Fprintf(w, "%s %s\n", ip, stat.added.Format(cacheWriteTimeFormat))
+	for job := range core.actions {
+		startedAt := time.Now()
+		err := job.act.Execute(job.l)
 		if err != nil {
-			return 0, fmt.Errorf("cannot save cache: %w", err)
+			log.Printf("cannot execute action: %v", err)
 		}
+		core.executionMeasure(time.Since(startedAt).Seconds())
 	}
-
-	return len(c.data), nil
 }
 
-func (c *ipCache) saver() {
-	if c.path == "" {
-		return
+// unbanner periodically execute unblock action for expired bans,
+// bans expired while botassasin was not running are executed on first run
+func (core *appcore) unbanner() {
+	ticker := time.NewTicker(unbanInterval)
+
+	for {
+		now := time.Now()
+
+		core.unbanExpired(now)
+		core.bans.Prune(now)
+
+		select {
+		case <-core.stop:
+			ticker.Stop()
+			return
+		case <-ticker.C:
+		}
 	}
+}
 
-	ticker := time.NewTicker(saveInterval)
+// unbanExpired execute unblock action for expired bans, ban stay active
+// until unblock action succeed, so failed unblock is retried on next tick
+func (core *appcore) unbanExpired(now time.Time) {
+	for _, target := range core.bans.Expired(now) {
+		log.Printf("ban for %s expired", target)
 
-	for range ticker.C {
-		f, err := os.Create(c.path)
+		l, err := banTargetLine(target)
 		if err != nil {
-			log.Printf("can not open file for save cache: %v", err)
+			// never can be unblocked, so do not retry
+			log.Printf("cannot unblock %s: %v", target, err)
+			core.bans.Unbanned(target, now)
 			continue
 		}
 
-		count, err := c.writeTo(f)
+		err = core.current().unblock.Execute(l)
 		if err != nil {
-			log.Printf("cannot write cache to file: %v", err)
-			f.Close()
+			log.Printf("cannot execute unblock action for %s: %v", target, err)
 			continue
 		}
 
-		f.Close()
-		log.Printf("cache saved %d records", count)
+		core.bans.Unbanned(target, now)
+		core.blockCache.removeKey(target)
+		core.subnets.remove(target)
+	}
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
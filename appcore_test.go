@@ -0,0 +1,468 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// staticChecker return same decision for every line
+type staticChecker struct {
+	decision instantDecision
+}
+
+func (c staticChecker) Check(l *logLine) (harmScore, instantDecision) {
+	return 0, c.decision
+}
+
+func newTestPipeline(t *testing.T, checkers ...checker) *pipeline {
+	t.Helper()
+
+	c := &chain{
+		reportFn: func(name string, seconds float64) {},
+		rechecks: make(chan *logLine),
+	}
+
+	for _, chk := range checkers {
+		c.checkers = append(c.checkers, &checkerWithKind{checker: chk, kind: "test"})
+	}
+
+	lp, err := newlogPrinterFromWriter(ioutil.Discard, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &pipeline{
+		c:       c,
+		act:     &action{},
+		unblock: &action{},
+		log:     lp,
+	}
+}
+
+func newTestLine(ip net.IP) *logLine {
+	return &logLine{ip: ip, fields: map[string]string{}}
+}
+
+func newTestAppCore(p *pipeline, bans *banLedger) *appcore {
+	noop := func(string) {}
+	noopMeasure := func(float64) {}
+
+	return newAppCore(nil, p, ipCacheConfig{}, bans, noop, noopMeasure, noopMeasure)
+}
+
+func Test_appcore_swap_fullQueue(t *testing.T) {
+	core := newTestAppCore(newTestPipeline(t, staticChecker{decision: decisionBan}), newBanLedger("", nil, 0))
+
+	// executor is not started, so queue is not drained
+	for i := 0; i < actionQueueSize; i++ {
+		core.decide(newTestLine(net.IPv4(10, 0, byte(i>>8), byte(i))), false)
+	}
+
+	blocked := make(chan struct{})
+	go func() {
+		core.decide(newTestLine(net.IPv4(10, 1, 0, 0)), false)
+		close(blocked)
+	}()
+
+	// wait until decide is blocked by full queue
+	time.Sleep(time.Millisecond * 50)
+
+	swapped := make(chan struct{})
+	go func() {
+		core.swap(newTestPipeline(t))
+		close(swapped)
+	}()
+
+	select {
+	case <-swapped:
+	case <-time.After(time.Second):
+		t.Fatal("swap() is blocked by full action queue")
+	}
+
+	go core.executor()
+
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("decide() is not unblocked by executor")
+	}
+}
+
+// countingChecker count checked lines and set cidr of ban
+type countingChecker struct {
+	checked  int
+	cidr     string
+	decision instantDecision
+}
+
+func (c *countingChecker) Check(l *logLine) (harmScore, instantDecision) {
+	c.checked++
+
+	if c.cidr != "" {
+		l.Set(cidrField, c.cidr)
+	}
+
+	return 0, c.decision
+}
+
+func Test_appcore_decide_bannedSubnet(t *testing.T) {
+	chk := &countingChecker{cidr: "10.1.0.0/16", decision: decisionBan}
+	core := newTestAppCore(newTestPipeline(t, chk), newBanLedger("", nil, 0))
+
+	core.decide(newTestLine(net.IPv4(10, 1, 0, 1)), false)
+
+	if len(core.actions) != 1 {
+		t.Fatalf("got %d queued actions, want 1", len(core.actions))
+	}
+
+	// other IPs of banned subnet are not checked
+	core.decide(newTestLine(net.IPv4(10, 1, 0, 2)), false)
+	core.decide(newTestLine(net.IPv4(10, 1, 200, 3)), false)
+
+	if chk.checked != 1 {
+		t.Errorf("checker called %d times, want 1", chk.checked)
+	}
+
+	if len(core.actions) != 1 {
+		t.Errorf("got %d queued actions, want 1", len(core.actions))
+	}
+
+	core.decide(newTestLine(net.IPv4(10, 2, 0, 1)), false)
+
+	if chk.checked != 2 {
+		t.Errorf("checker called %d times for IP out of subnet, want 2", chk.checked)
+	}
+}
+
+// hitRecorder count hits by kind
+type hitRecorder struct {
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func (r *hitRecorder) hit(name string) {
+	r.mu.Lock()
+	r.hits[name]++
+	r.mu.Unlock()
+}
+
+func (r *hitRecorder) get(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.hits[name]
+}
+
+func Test_appcore_decide_blockCache(t *testing.T) {
+	chk := &countingChecker{decision: decisionBan}
+	core := newTestAppCore(newTestPipeline(t, chk), newBanLedger("", nil, 0))
+
+	rec := &hitRecorder{hits: map[string]int{}}
+	core.hit = rec.hit
+
+	ip := net.IPv4(1, 2, 3, 4)
+
+	for i := 0; i < 3; i++ {
+		core.decide(newTestLine(ip), false)
+	}
+
+	if len(core.actions) != 1 {
+		t.Errorf("got %d queued actions, want 1", len(core.actions))
+	}
+
+	if chk.checked != 1 {
+		t.Errorf("checker called %d times, want 1", chk.checked)
+	}
+
+	if got := rec.get("blocklist"); got != 2 {
+		t.Errorf("got %d blocklist hits, want 2", got)
+	}
+
+	// checker ban subnet of other IP which is already blocked
+	chk.cidr = "1.2.3.0/24"
+	core.decide(newTestLine(net.IPv4(1, 2, 4, 1)), false)
+	core.decide(newTestLine(net.IPv4(1, 2, 5, 1)), false)
+
+	if len(core.actions) != 2 {
+		t.Errorf("got %d queued actions, want 2", len(core.actions))
+	}
+
+	before := testutil.ToFloat64(duplicateBlocksCounter)
+
+	core.decide(newTestLine(net.IPv4(5, 5, 5, 5)), false)
+
+	if got := testutil.ToFloat64(duplicateBlocksCounter) - before; got != 1 {
+		t.Errorf("got %v duplicate blocks, want 1", got)
+	}
+}
+
+func Test_appcore_decide_noIP(t *testing.T) {
+	chk := &countingChecker{decision: decisionBan}
+	bans := newBanLedger("", nil, 0)
+	core := newTestAppCore(newTestPipeline(t, chk), bans)
+
+	// line is not matched by log format
+	core.decide(newTestLine(nil), false)
+
+	if chk.checked != 0 {
+		t.Errorf("checker called %d times for line without IP, want 0", chk.checked)
+	}
+
+	if len(core.actions) != 0 {
+		t.Errorf("got %d queued actions, want 0", len(core.actions))
+	}
+
+	if active := bans.Active(); len(active) != 0 {
+		t.Errorf("got bans %v, want none", active)
+	}
+}
+
+func Test_appcore_restoreBans(t *testing.T) {
+	bans := newBanLedger("", []time.Duration{time.Hour}, 0)
+	bans.BanTarget("1.2.3.4")
+	bans.BanTarget("10.0.0.0/8")
+
+	chk := &countingChecker{decision: decisionBan}
+	core := newTestAppCore(newTestPipeline(t, chk), bans)
+
+	core.decide(newTestLine(net.IPv4(1, 2, 3, 4)), false)
+	core.decide(newTestLine(net.IPv4(10, 20, 30, 40)), false)
+
+	if chk.checked != 0 || len(core.actions) != 0 {
+		t.Errorf("IPs banned before restart are checked %d times, %d actions queued", chk.checked, len(core.actions))
+	}
+}
+
+func Test_appcore_unbanExpired(t *testing.T) {
+	bans := newBanLedger("", []time.Duration{time.Minute}, 0)
+	bans.BanTarget("1.2.3.4")
+
+	p := newTestPipeline(t)
+
+	failing, err := newAction([]string{"sh", "-c", "exit 1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.unblock = failing
+
+	core := newTestAppCore(p, bans)
+	now := time.Now().Add(time.Hour)
+
+	core.unbanExpired(now)
+
+	// failed unblock keep ban active for retry
+	if got := bans.Active(); len(got) != 1 {
+		t.Fatalf("after failed unblock active bans = %v, want [1.2.3.4]", got)
+	}
+	if !core.blockCache.Contains(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("after failed unblock IP is removed from block cache")
+	}
+
+	p.unblock = &action{}
+
+	core.unbanExpired(now)
+
+	if got := bans.Active(); len(got) != 0 {
+		t.Errorf("after retried unblock active bans = %v, want empty", got)
+	}
+	if core.blockCache.Contains(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("after retried unblock IP is kept in block cache")
+	}
+}
+
+func Test_appcore_executor(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "actions.txt")
+
+	p := newTestPipeline(t, staticChecker{decision: decisionBan})
+
+	act, err := newAction([]string{"sh", "-c", "echo {{.ip}} >> " + out})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.act = act
+
+	core := newTestAppCore(p, newBanLedger("", nil, 0))
+
+	var want []string
+
+	// executor is not started, queue is filled up to its size
+	for i := 0; i < actionQueueSize; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		want = append(want, ip.String())
+		core.decide(newTestLine(ip), false)
+	}
+
+	// decide wait for free place in queue
+	last := net.IPv4(10, 1, 0, 0)
+	want = append(want, last.String())
+
+	queued := make(chan struct{})
+	go func() {
+		core.decide(newTestLine(last), false)
+		close(queued)
+	}()
+
+	select {
+	case <-queued:
+		t.Fatal("decide() is not blocked by full queue")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	go core.executor()
+
+	select {
+	case <-queued:
+	case <-time.After(time.Second * 5):
+		t.Fatal("decide() is not unblocked by executor")
+	}
+
+	err = core.shutdown(time.Second * 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Fields(string(data))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("actions executed in wrong order, got %d actions", len(got))
+	}
+}
+
+// asyncChecker return provisional decision on first check and keep copy
+// of line for recheck like asynchronous reverse DNS checker
+type asyncChecker struct {
+	provisional instantDecision
+	final       instantDecision
+
+	checked int
+	line    *logLine
+}
+
+func (c *asyncChecker) Check(l *logLine) (harmScore, instantDecision) {
+	c.checked++
+
+	if c.checked > 1 {
+		return 0, c.final
+	}
+
+	c.line = l.Clone()
+	c.line.recheckHeld = c.provisional == decisionHold
+
+	return 0, c.provisional
+}
+
+func Test_appcore_recheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		provisional instantDecision
+		final       instantDecision
+		wantActions int
+	}{
+		{
+			name:        "held and banned",
+			provisional: decisionHold,
+			final:       decisionBan,
+			wantActions: 1,
+		},
+		{
+			name:        "held and passed",
+			provisional: decisionHold,
+			final:       decisionNone,
+			wantActions: 0,
+		},
+		{
+			name:        "passed and banned",
+			provisional: decisionNone,
+			final:       decisionBan,
+			wantActions: 1,
+		},
+		{
+			name:        "passed and passed",
+			provisional: decisionNone,
+			final:       decisionNone,
+			wantActions: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := &countingChecker{decision: decisionNone}
+			async := &asyncChecker{provisional: tt.provisional, final: tt.final}
+			after := &countingChecker{decision: decisionNone}
+
+			core := newTestAppCore(newTestPipeline(t, before, async, after), newBanLedger("", nil, 0))
+
+			core.decide(newTestLine(net.IPv4(1, 2, 3, 4)), false)
+			core.recheck(async.line)
+
+			// every checker see line only once
+			if before.checked != 1 {
+				t.Errorf("checker before asynchronous called %d times, want 1", before.checked)
+			}
+
+			wantAfter := 1
+			if tt.final == decisionBan && tt.provisional == decisionHold {
+				wantAfter = 0
+			}
+
+			if after.checked != wantAfter {
+				t.Errorf("checker after asynchronous called %d times, want %d", after.checked, wantAfter)
+			}
+
+			if len(core.actions) != tt.wantActions {
+				t.Errorf("got %d queued actions, want %d", len(core.actions), tt.wantActions)
+			}
+
+			// not decided line must not be whitelisted
+			if _, ok := core.passCache.Lookup(net.IPv4(1, 2, 3, 4)); ok {
+				t.Error("rechecked line without decision is cached as whitelisted")
+			}
+		})
+	}
+}
+
+func Test_appcore_recheck_reload(t *testing.T) {
+	async := &asyncChecker{provisional: decisionHold, final: decisionBan}
+	p := newTestPipeline(t, async)
+
+	core := newTestAppCore(p, newBanLedger("", nil, 0))
+
+	core.decide(newTestLine(net.IPv4(1, 2, 3, 4)), false)
+
+	// asynchronous checker is replaced by reload while line is held
+	next := newTestPipeline(t, &asyncChecker{provisional: decisionHold, final: decisionBan})
+	core.swap(next)
+
+	before := testutil.ToFloat64(rechecksAbandonedCounter)
+
+	core.recheck(async.line)
+
+	if got := testutil.ToFloat64(rechecksAbandonedCounter) - before; got != 1 {
+		t.Errorf("got %v abandoned rechecks, want 1", got)
+	}
+
+	if len(core.actions) != 0 {
+		t.Errorf("got %d queued actions, want 0", len(core.actions))
+	}
+
+	// reused checker continue recheck
+	next.c.checkers = append(next.c.checkers, p.c.checkers[0])
+
+	core.recheck(async.line)
+
+	if len(core.actions) != 1 {
+		t.Errorf("got %d queued actions for reused checker, want 1", len(core.actions))
+	}
+}
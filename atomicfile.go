@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic write file via temporary file and rename, so file
+// is never left half written
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %w", err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", tmp.Name(), err)
+	}
+
+	err = os.Chmod(tmp.Name(), 0600)
+	if err != nil {
+		return fmt.Errorf("cannot chmod %s: %w", tmp.Name(), err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	permanentBanMark = "permanent"
+	unbanInterval    = time.Second * 10
+
+	// expired bans older than this are forgotten and offence count start again
+	defaultBanForgetAfter = time.Hour * 24 * 30
+
+	banStateActive  = "active"
+	banStateExpired = "expired"
+
+	banCountField    = "ban_count"
+	banDurationField = "ban_duration"
+)
+
+type banRecord struct {
+	// number of bans for IP
+	count     int
+	active    bool
+	bannedAt  time.Time
+	expiresAt time.Time
+}
+
+// banLedger keep track of banned IPs and time when ban expires,
+// records of expired bans are kept for escalate next ban of same IP
+// until forget window is over
+type banLedger struct {
+	path string
+	// ban duration for first, second, etc ban, last step used for all next bans
+	steps []time.Duration
+	// zero means expired bans are never forgotten
+	forgetAfter time.Duration
+
+	mu    *sync.Mutex
+	dirty bool
+	data  map[string]banRecord
+}
+
+func newBanLedger(path string, steps []time.Duration, forgetAfter time.Duration) *banLedger {
+	if len(steps) == 0 {
+		steps = []time.Duration{0}
+	}
+
+	return &banLedger{
+		path:        path,
+		steps:       steps,
+		forgetAfter: forgetAfter,
+		mu:          &sync.Mutex{},
+		data:        map[string]banRecord{},
+	}
+}
+
+func newBanLedgerFromFile(path string, steps []time.Duration, forgetAfter time.Duration) (*banLedger, error) {
+	ledger := newBanLedger(path, steps, forgetAfter)
+
+	if path == "" {
+		return ledger, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open ban ledger %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		str := scanner.Text()
+
+		strIP, rec, err := parseBanRecord(str)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse ban ledger line %q: %w", str, err)
+		}
+
+		ledger.data[strIP] = rec
+	}
+
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("cannot read ban ledger: %w", scanner.Err())
+	}
+
+	log.Printf("%d records loaded from ban ledger %s", len(ledger.data), path)
+
+	forgotten := ledger.Prune(time.Now())
+	if forgotten > 0 {
+		log.Printf("%d expired bans forgotten", forgotten)
+	}
+
+	return ledger, nil
+}
+
+// parseBanRecord parse line in format "ip count banned_at expires_at state",
+// old format "ip banned_at expires_at" is also supported
+func parseBanRecord(str string) (string, banRecord, error) {
+	parts := strings.Fields(str)
+
+	rec := banRecord{
+		count:  1,
+		active: true,
+	}
+
+	switch len(parts) {
+	case 3:
+		parts = []string{parts[0], "1", parts[1], parts[2], banStateActive}
+	case 5:
+	default:
+		return "", rec, fmt.Errorf("unexpected number of fields %d", len(parts))
+	}
+
+	var err error
+
+	rec.count, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return "", rec, fmt.Errorf("cannot parse ban count %q: %w", parts[1], err)
+	}
+
+	rec.bannedAt, err = time.Parse(cacheWriteTimeFormat, parts[2])
+	if err != nil {
+		return "", rec, fmt.Errorf("cannot parse time %q: %w", parts[2], err)
+	}
+
+	if parts[3] != permanentBanMark {
+		rec.expiresAt, err = time.Parse(cacheWriteTimeFormat, parts[3])
+		if err != nil {
+			return "", rec, fmt.Errorf("cannot parse time %q: %w", parts[3], err)
+		}
+	}
+
+	rec.active = parts[4] == banStateActive
+
+	return parts[0], rec, nil
+}
+
+// Ban record ban of ip, every next ban of same IP use next escalation step
+func (bl *banLedger) Ban(ip net.IP) banRecord {
+	return bl.BanTarget(ip.String())
+}
+
+// BanTarget record ban of IP or subnet in CIDR notation, ban is escalated
+// only when previous ban is over, active ban is returned as is
+func (bl *banLedger) BanTarget(target string) banRecord {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	now := time.Now()
+
+	rec, ok := bl.data[target]
+	if ok && rec.active && (rec.permanent() || rec.expiresAt.After(now)) {
+		return rec
+	}
+
+	if ok && bl.forgotten(rec, now) {
+		rec = banRecord{}
+	}
+
+	rec.count++
+	rec.active = true
+	rec.bannedAt = now
+	rec.expiresAt = time.Time{}
+
+	duration := bl.duration(rec.count)
+	if duration > 0 {
+		rec.expiresAt = now.Add(duration)
+	}
+
+	bl.data[target] = rec
+	bl.dirty = true
+
+	return rec
+}
+
+// duration of ban number n, zero duration means permanent ban
+func (bl *banLedger) duration(n int) time.Duration {
+	if n > len(bl.steps) {
+		n = len(bl.steps)
+	}
+
+	return bl.steps[n-1]
+}
+
+// Expired return IPs and subnets which ban time is over, they are returned
+// again until marked by Unbanned
+func (bl *banLedger) Expired(now time.Time) []string {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	var targets []string
+
+	for target, rec := range bl.data {
+		if !rec.active || rec.permanent() || rec.expiresAt.After(now) {
+			continue
+		}
+
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// Unbanned mark expired ban as not active after unblock action is done,
+// ban renewed meanwhile is kept
+func (bl *banLedger) Unbanned(target string, now time.Time) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	rec, ok := bl.data[target]
+	if !ok || !rec.active || rec.permanent() || rec.expiresAt.After(now) {
+		return
+	}
+
+	rec.active = false
+	bl.data[target] = rec
+	bl.dirty = true
+}
+
+// Prune remove records of bans expired before forget window and return
+// number of removed records
+func (bl *banLedger) Prune(now time.Time) int {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	count := 0
+
+	for target, rec := range bl.data {
+		if !bl.forgotten(rec, now) {
+			continue
+		}
+
+		delete(bl.data, target)
+		bl.dirty = true
+		count++
+	}
+
+	return count
+}
+
+// forgotten ban is unblocked and forget window is over
+func (bl *banLedger) forgotten(rec banRecord, now time.Time) bool {
+	if bl.forgetAfter <= 0 || rec.active || rec.permanent() {
+		return false
+	}
+
+	return rec.expiresAt.Add(bl.forgetAfter).Before(now)
+}
+
+// Active return IPs and subnets with active ban
+func (bl *banLedger) Active() []string {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	var targets []string
+
+	for target, rec := range bl.data {
+		if rec.active {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets
+}
+
+func (bl *banLedger) writeTo(w io.Writer) (int, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	for ip, rec := range bl.data {
+		expires := permanentBanMark
+		if !rec.permanent() {
+			expires = rec.expiresAt.Format(cacheWriteTimeFormat)
+		}
+
+		state := banStateExpired
+		if rec.active {
+			state = banStateActive
+		}
+
+		_, err := fmt.Fprintf(w, "%s %d %s %s %s\n", ip, rec.count, rec.bannedAt.Format(cacheWriteTimeFormat), expires, state)
+		if err != nil {
+			return 0, fmt.Errorf("cannot save ban ledger: %w", err)
+		}
+	}
+
+	bl.dirty = false
+
+	return len(bl.data), nil
+}
+
+func (bl *banLedger) isDirty() bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	return bl.dirty
+}
+
+// Save write ledger to disk atomically if it was changed
+func (bl *banLedger) Save() (int, error) {
+	if bl.path == "" || !bl.isDirty() {
+		return 0, nil
+	}
+
+	var count int
+
+	err := writeFileAtomic(bl.path, func(w io.Writer) error {
+		var err error
+		count, err = bl.writeTo(w)
+		return err
+	})
+
+	return count, err
+}
+
+func (bl *banLedger) saver(stop <-chan struct{}) {
+	if bl.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if !bl.isDirty() {
+			continue
+		}
+
+		count, err := bl.Save()
+		if err != nil {
+			log.Printf("cannot save ban ledger: %v", err)
+			continue
+		}
+
+		log.Printf("ban ledger saved %d records", count)
+	}
+}
+
+func (rec banRecord) permanent() bool {
+	return rec.expiresAt.IsZero()
+}
+
+// Duration human readable duration of ban
+func (rec banRecord) Duration() string {
+	if rec.permanent() {
+		return permanentBanMark
+	}
+
+	return rec.expiresAt.Sub(rec.bannedAt).String()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// unban mark all expired bans as unblocked
+func unban(bl *banLedger, now time.Time) {
+	for _, target := range bl.Expired(now) {
+		bl.Unbanned(target, now)
+	}
+}
+
+func Test_banLedger_Expired(t *testing.T) {
+	tests := []struct {
+		name        string
+		duration    time.Duration
+		after       time.Duration
+		wantExpired int
+	}{
+		{
+			name:        "active ban",
+			duration:    time.Hour,
+			after:       time.Minute,
+			wantExpired: 0,
+		},
+		{
+			name:        "expired ban",
+			duration:    time.Minute,
+			after:       time.Hour,
+			wantExpired: 1,
+		},
+		{
+			name:        "permanent ban",
+			duration:    0,
+			after:       time.Hour * 24 * 365,
+			wantExpired: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bl := newBanLedger("", []time.Duration{tt.duration}, 0)
+			bl.Ban(net.IPv4(1, 2, 3, 4))
+
+			now := time.Now().Add(tt.after)
+
+			got := bl.Expired(now)
+			if len(got) != tt.wantExpired {
+				t.Errorf("banLedger.Expired() = %v, want %d records", got, tt.wantExpired)
+			}
+
+			// not unblocked records are returned again for retry
+			if got := bl.Expired(now); len(got) != tt.wantExpired {
+				t.Errorf("banLedger.Expired() second call = %v, want %d records", got, tt.wantExpired)
+			}
+
+			unban(bl, now)
+
+			if got := bl.Expired(now); len(got) != 0 {
+				t.Errorf("banLedger.Expired() after unban = %v, want empty", got)
+			}
+		})
+	}
+}
+
+func Test_banLedger_Ban_Escalation(t *testing.T) {
+	steps := []time.Duration{time.Minute * 10, time.Hour, time.Hour * 24, 0}
+
+	tests := []struct {
+		wantCount    int
+		wantDuration string
+	}{
+		{wantCount: 1, wantDuration: "10m0s"},
+		{wantCount: 2, wantDuration: "1h0m0s"},
+		{wantCount: 3, wantDuration: "24h0m0s"},
+		{wantCount: 4, wantDuration: permanentBanMark},
+		// permanent ban is never over
+		{wantCount: 4, wantDuration: permanentBanMark},
+	}
+
+	bl := newBanLedger("", steps, 0)
+	ip := net.IPv4(1, 2, 3, 4)
+
+	for _, tt := range tests {
+		rec := bl.Ban(ip)
+		if rec.count != tt.wantCount {
+			t.Errorf("banLedger.Ban() count = %d, want %d", rec.count, tt.wantCount)
+		}
+		if rec.Duration() != tt.wantDuration {
+			t.Errorf("banLedger.Ban() duration = %s, want %s", rec.Duration(), tt.wantDuration)
+		}
+
+		unban(bl, time.Now().Add(time.Hour*48))
+	}
+}
+
+func Test_banLedger_Ban_Active(t *testing.T) {
+	bl := newBanLedger("", []time.Duration{time.Hour, time.Hour * 24, 0}, 0)
+	ip := net.IPv4(1, 2, 3, 4)
+
+	first := bl.Ban(ip)
+
+	// duplicate lines of IP with active ban must not escalate
+	for i := 0; i < 5; i++ {
+		rec := bl.Ban(ip)
+		if rec.count != 1 || rec.bannedAt != first.bannedAt {
+			t.Fatalf("banLedger.Ban() of active ban count = %d, want 1", rec.count)
+		}
+	}
+
+	unban(bl, time.Now().Add(time.Hour*2))
+
+	if rec := bl.Ban(ip); rec.count != 2 {
+		t.Errorf("banLedger.Ban() after expire count = %d, want 2", rec.count)
+	}
+}
+
+func Test_banLedger_Unbanned_renewed(t *testing.T) {
+	bl := newBanLedger("", []time.Duration{time.Minute, time.Hour}, 0)
+	bl.Ban(net.IPv4(1, 2, 3, 4))
+
+	now := time.Now().Add(time.Minute * 2)
+	expired := bl.Expired(now)
+
+	// IP is banned again while unblock action is running
+	bl.data["1.2.3.4"] = banRecord{count: 2, active: true, bannedAt: now, expiresAt: now.Add(time.Hour)}
+
+	for _, target := range expired {
+		bl.Unbanned(target, now)
+	}
+
+	if got := bl.Active(); len(got) != 1 {
+		t.Errorf("banLedger.Active() = %v, want renewed ban", got)
+	}
+}
+
+func Test_banLedger_Prune(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name        string
+		forgetAfter time.Duration
+		rec         banRecord
+		wantPruned  int
+		wantCount   int
+	}{
+		{
+			name:        "forgotten",
+			forgetAfter: time.Hour,
+			rec:         banRecord{count: 3, bannedAt: now.Add(-time.Hour * 3), expiresAt: now.Add(-time.Hour * 2)},
+			wantPruned:  1,
+			wantCount:   1,
+		},
+		{
+			name:        "inside forget window",
+			forgetAfter: time.Hour * 24,
+			rec:         banRecord{count: 3, bannedAt: now.Add(-time.Hour * 3), expiresAt: now.Add(-time.Hour * 2)},
+			wantPruned:  0,
+			wantCount:   4,
+		},
+		{
+			name:        "not unblocked yet",
+			forgetAfter: time.Hour,
+			rec:         banRecord{count: 3, active: true, bannedAt: now.Add(-time.Hour * 3), expiresAt: now.Add(-time.Hour * 2)},
+			wantPruned:  0,
+			wantCount:   4,
+		},
+		{
+			name:        "permanent",
+			forgetAfter: time.Hour,
+			rec:         banRecord{count: 3, active: true, bannedAt: now.Add(-time.Hour * 24 * 365)},
+			wantPruned:  0,
+			wantCount:   3,
+		},
+		{
+			name:        "never forget",
+			forgetAfter: 0,
+			rec:         banRecord{count: 3, bannedAt: now.Add(-time.Hour * 24 * 365), expiresAt: now.Add(-time.Hour * 24 * 364)},
+			wantPruned:  0,
+			wantCount:   4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newLedger := func() *banLedger {
+				bl := newBanLedger("", []time.Duration{time.Minute}, tt.forgetAfter)
+				bl.data["1.2.3.4"] = tt.rec
+				return bl
+			}
+
+			if got := newLedger().Prune(now); got != tt.wantPruned {
+				t.Errorf("banLedger.Prune() = %d, want %d", got, tt.wantPruned)
+			}
+
+			// offence count start again when record is forgotten
+			if rec := newLedger().BanTarget("1.2.3.4"); rec.count != tt.wantCount {
+				t.Errorf("banLedger.BanTarget() count = %d, want %d", rec.count, tt.wantCount)
+			}
+		})
+	}
+}
+
+func Test_banLedger_Restore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botassasin_ledger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bans.txt")
+
+	bl := newBanLedger(path, []time.Duration{time.Minute}, 0)
+	bl.Ban(net.IPv4(1, 2, 3, 4))
+
+	permanent := newBanLedger(path, nil, 0)
+	permanent.Ban(net.IPv4(5, 6, 7, 8))
+
+	buf := bytes.NewBuffer([]byte{})
+
+	_, err = bl.writeTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = permanent.writeTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := newBanLedgerFromFile(path, []time.Duration{time.Minute}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(restored.data) != 2 {
+		t.Fatalf("restored %d records, want 2", len(restored.data))
+	}
+
+	// ban expired while botassasin was not running
+	now := time.Now().Add(time.Hour)
+
+	got := restored.Expired(now)
+	if len(got) != 1 || got[0] != "1.2.3.4" {
+		t.Errorf("banLedger.Expired() = %v, want [1.2.3.4]", got)
+	}
+
+	unban(restored, now)
+
+	// offence count survive restart
+	if rec := restored.Ban(net.IPv4(1, 2, 3, 4)); rec.count != 2 {
+		t.Errorf("banLedger.Ban() count = %d, want 2", rec.count)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io"
 	"io/fs"
 	"log"
@@ -23,9 +24,10 @@ const (
 )
 
 var (
-	preparedLogs = [1][]byte{
-		[]byte(`176.59.46.121 - - [23/Aug/2022:09:52:09 +0000] "GET /api/application/items/?item_ids=3633 HTTP/2.0" 200 22 "https://pizzafabrika.ru/order.html" "Mozilla/5.0 (Linux; Android 10; HRY-LX1T Build/HONORHRY-LX1T; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/103.0.5060.129 Mobile Safari/537.36" rt=0.066 uct="0.001" uht="0.067" urt="0.067"
-`),
+	// time of write is added at the end of line like nginx $msec
+	preparedLogs = [1]string{
+		`176.59.46.121 - - [23/Aug/2022:09:52:09 +0000] "GET /api/application/items/?item_ids=3633 HTTP/2.0" 200 22 "https://pizzafabrika.ru/order.html" "Mozilla/5.0 (Linux; Android 10; HRY-LX1T Build/HONORHRY-LX1T; wv) AppleWebKit/537.36 (KHTML, like Gecko) Version/4.0 Chrome/103.0.5060.129 Mobile Safari/537.36" rt=0.066 uct="0.001" uht="0.067" urt="0.067" msec=%d.%06d
+`,
 	}
 
 	linesWrittenBeforeReport uint64
@@ -35,9 +37,16 @@ var (
 	})
 )
 
+// logwriter append lines to log file with fixed delay between writes.
+// Every line end with time of write, so with log_format capturing it
+// (ex. `msec=(?P<msec>\S+)$`) botassasin_line_latency_seconds metric of
+// botassasin show time from write of line to decision. With big delay
+// (ex. 100000000 ns) lines are written one by one to idle log, so metric
+// show how fast new line is noticed. With small delay throughput can be
+// measured by botassasin_records_processed_total.
 func main() {
 	if len(os.Args) == 1 {
-		log.Fatal("Usage: logwriter <file> [delay ms]")
+		log.Fatal("Usage: logwriter <file> [delay ns]")
 	}
 
 	logfile := os.Args[1]
@@ -80,7 +89,9 @@ func writer(w io.Writer, delayAfterWrite time.Duration) error {
 	go report()
 
 	for {
-		_, err = w.Write(preparedLogs[0])
+		now := time.Now()
+
+		_, err = fmt.Fprintf(w, preparedLogs[0], now.Unix(), now.Nanosecond()/int(time.Microsecond))
 		if err != nil {
 			return err
 		}
@@ -4,6 +4,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +18,8 @@ const (
 	decisionNone instantDecision = iota
 	decisionBan
 	decisionWhitelist
+	// line is not decided yet, checker will send it again for decision
+	decisionHold
 
 	checkerField     = "checker"
 	scoreField       = "score"
@@ -33,44 +37,138 @@ type checker interface {
 type checkerWithKind struct {
 	checker
 	kind string
+	// config checker was created from, used for reuse checker on reload
+	cfg checkerConfig
+}
+
+// stateSaver is checker which keep state in file, state is saved before
+// checkers are created again on reload, so new checker load latest state
+type stateSaver interface {
+	SaveState() error
+}
+
+// rechecker is checker which make decision asynchronously, lines are sent
+// to recheck channel when decision is ready
+type rechecker interface {
+	setRecheck(recheck chan<- *logLine)
 }
 
 type chain struct {
 	reportFn reportCheckerWorkTime
 	checkers []*checkerWithKind
+	rechecks chan *logLine
 }
 
 type reportCheckerWorkTime func(name string, seconds float64)
 
-func newChainFromConfig(cfg config, reportFn reportCheckerWorkTime) (*chain, error) {
+// newChainFromConfig create chain, checkers of old chain with same config
+// are reused with their state, old can be nil
+func newChainFromConfig(cfg config, reportFn reportCheckerWorkTime, old *chain) (*chain, error) {
 	var checkers []*checkerWithKind
 
+	reused := map[*checkerWithKind]bool{}
+
 	for _, checkerCfg := range cfg.Checkers {
+		c := old.find(checkerCfg, reused)
+		if c != nil {
+			reused[c] = true
+			checkers = append(checkers, c)
+			continue
+		}
+
 		c, err := checkerFromConfig(checkerCfg)
 		if err != nil {
+			// close only checkers created for this chain
+			(&chain{checkers: checkers}).closeExcept(old)
 			return nil, fmt.Errorf("cannot create checker: %w", err)
 		}
 
+		c.cfg = checkerCfg
 		checkers = append(checkers, c)
 	}
 
+	// lines sent by asynchronous checkers before reload are not lost
+	rechecks := make(chan *logLine)
+	if old != nil {
+		rechecks = old.rechecks
+	}
+
+	for _, c := range checkers {
+		if r, ok := c.checker.(rechecker); ok {
+			r.setRecheck(rechecks)
+		}
+	}
+
 	return &chain{
 		reportFn: reportFn,
 		checkers: checkers,
+		rechecks: rechecks,
 	}, nil
 }
 
+// Rechecks return lines which should be decided again
+func (c *chain) Rechecks() <-chan *logLine {
+	return c.rechecks
+}
+
 func (c *chain) NeedBan(l *logLine) bool {
-	score := harmScore(0)
+	return c.Decide(l) == decisionBan
+}
 
-	for _, chk := range c.checkers {
-		startedAt := time.Now()
+// Decide return decisionBan when IP should be banned, decisionWhitelist
+// and decisionHold when checker made such decision, decisionNone otherwise
+func (c *chain) Decide(l *logLine) instantDecision {
+	return c.decideFrom(l, c.checkers, 0)
+}
+
+// Recheck decide line sent by asynchronous checker from position of that
+// checker, so checkers before it do not count line twice. Line which was not
+// held is seen by next checkers already, only decision of asynchronous
+// checker is used for it. ok is false if checker is removed by reload.
+func (c *chain) Recheck(l *logLine) (decision instantDecision, ok bool) {
+	for i, chk := range c.checkers {
+		if chk.checker != l.recheckFrom {
+			continue
+		}
+
+		if l.recheckHeld {
+			return c.decideFrom(l, c.checkers[i:], l.recheckScore), true
+		}
+
+		_, decision = c.check(chk, l, 0)
+		if decision != decisionNone {
+			l.Set(checkerField, chk.kind)
+			return decision, true
+		}
+
+		l.Set(checkerField, scoreCheckerName)
 
-		s, decision := chk.Check(l)
+		return decisionNone, true
+	}
+
+	return decisionNone, false
+}
 
-		c.reportFn(chk.kind, time.Since(startedAt).Seconds())
+func (c *chain) check(chk *checkerWithKind, l *logLine, score harmScore) (harmScore, instantDecision) {
+	// asynchronous checker copy line with its position
+	l.recheckFrom = chk.checker
+	l.recheckScore = score
+	l.recheckHeld = false
 
-		log.Debugf("%s %s score: %d decision: %s", l.IP(), chk.kind, s, decision)
+	startedAt := time.Now()
+
+	s, decision := chk.Check(l)
+
+	c.reportFn(chk.kind, time.Since(startedAt).Seconds())
+
+	log.Debugf("%s %s score: %d decision: %s", l.IP(), chk.kind, s, decision)
+
+	return s, decision
+}
+
+func (c *chain) decideFrom(l *logLine, checkers []*checkerWithKind, score harmScore) instantDecision {
+	for _, chk := range checkers {
+		s, decision := c.check(chk, l, score)
 
 		if decision == decisionNone {
 			score += s
@@ -80,7 +178,7 @@ func (c *chain) NeedBan(l *logLine) bool {
 		l.Set(checkerField, chk.kind)
 		l.Set(scoreField, strconv.Itoa(int(score)))
 
-		return decision == decisionBan
+		return decision
 	}
 
 	log.Debugf("%s total score: %d", l.IP(), score)
@@ -88,7 +186,89 @@ func (c *chain) NeedBan(l *logLine) bool {
 	l.Set(checkerField, scoreCheckerName)
 	l.Set(scoreField, strconv.Itoa(int(score)))
 
-	return score > 0
+	if score > 0 {
+		return decisionBan
+	}
+
+	return decisionNone
+}
+
+// find return checker with same config which is not reused yet
+func (c *chain) find(cfg checkerConfig, reused map[*checkerWithKind]bool) *checkerWithKind {
+	if c == nil {
+		return nil
+	}
+
+	for _, chk := range c.checkers {
+		if !reused[chk] && chk.cfg != nil && reflect.DeepEqual(chk.cfg, cfg) {
+			return chk
+		}
+	}
+
+	return nil
+}
+
+// has return true if checker is part of chain
+func (c *chain) has(chk *checkerWithKind) bool {
+	if c == nil {
+		return false
+	}
+
+	for _, own := range c.checkers {
+		if own == chk {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SaveState save state of checkers to files
+func (c *chain) SaveState() error {
+	var err error
+
+	for _, chk := range c.checkers {
+		saver, ok := chk.checker.(stateSaver)
+		if !ok {
+			continue
+		}
+
+		saveErr := saver.SaveState()
+		if saveErr != nil {
+			err = firstErr(err, fmt.Errorf("cannot save state of %s checker: %w", chk.kind, saveErr))
+		}
+	}
+
+	return err
+}
+
+// Close release resources of checkers, chain is closed when it is
+// replaced by config reload
+func (c *chain) Close() error {
+	return c.closeExcept(nil)
+}
+
+// closeExcept close checkers which are not reused by next chain
+func (c *chain) closeExcept(next *chain) error {
+	var err error
+
+	for _, chk := range c.checkers {
+		if next.has(chk) {
+			continue
+		}
+
+		closer, ok := chk.checker.(io.Closer)
+		if !ok {
+			continue
+		}
+
+		closeErr := closer.Close()
+		if closeErr != nil {
+			err = firstErr(err, fmt.Errorf("cannot close %s checker: %w", chk.kind, closeErr))
+		}
+	}
+
+	return err
 }
 
 func checkerFromConfig(cfg checkerConfig) (*checkerWithKind, error) {
@@ -162,6 +342,66 @@ func checkerFromConfig(cfg checkerConfig) (*checkerWithKind, error) {
 
 		return &checkerWithKind{checker: rdns, kind: "reverse_dns"}, nil
 
+	case "rate":
+		c := rateCheckerConfig{}
+
+		err = unmarshalConfig(cfg, &c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal rate checker config: %w", err)
+		}
+
+		rate, err := newRateChecker(c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create rate checker: %w", err)
+		}
+
+		return &checkerWithKind{checker: rate, kind: "rate"}, nil
+
+	case "subnet_rate":
+		c := subnetRateCheckerConfig{}
+
+		err = unmarshalConfig(cfg, &c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal subnet rate checker config: %w", err)
+		}
+
+		rate, err := newSubnetRateChecker(c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create subnet rate checker: %w", err)
+		}
+
+		return &checkerWithKind{checker: rate, kind: "subnet_rate"}, nil
+
+	case "asn":
+		c := asnCheckerConfig{}
+
+		err = unmarshalConfig(cfg, &c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal ASN checker config: %w", err)
+		}
+
+		asn, err := newASNChecker(c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create ASN checker: %w", err)
+		}
+
+		return &checkerWithKind{checker: asn, kind: "asn"}, nil
+
+	case "verified_bots":
+		c := verifiedBotsCheckerConfig{}
+
+		err = unmarshalConfig(cfg, &c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal verified bots checker config: %w", err)
+		}
+
+		bots, err := newVerifiedBotsChecker(c)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create verified bots checker: %w", err)
+		}
+
+		return &checkerWithKind{checker: bots, kind: "verified_bots"}, nil
+
 	default:
 		return nil, fmt.Errorf("unknown checker %q", kindOnly.Kind)
 	}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	asnField   = "asn"
+	asOrgField = "as_org"
+
+	asnActionWhitelist = "whitelist"
+	asnActionBlock     = "block"
+	asnActionScore     = "score"
+)
+
+var _ checker = &asnChecker{}
+
+type asnRecord struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+type asnRuleConfig struct {
+	ASN         []uint   `yaml:"asn"`
+	OrgContains []string `yaml:"org_contains"`
+	// whitelist, block or score
+	Action string `yaml:"action"`
+	Score  int    `yaml:"score"`
+}
+
+type asnCheckerConfig struct {
+	Path  string          `yaml:"path"`
+	Rules []asnRuleConfig `yaml:"rules"`
+	// how often database file is checked for update
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+type asnRule struct {
+	asn         map[uint]bool
+	orgContains []string
+	decision    instantDecision
+	score       harmScore
+}
+
+// asnChecker set autonomous system of IP from GeoLite2-ASN database and
+// whitelist, block or score IP by first matched rule
+type asnChecker struct {
+	db    *mmdbReader
+	rules []asnRule
+}
+
+func newASNChecker(cfg asnCheckerConfig) (*asnChecker, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("path to ASN database is required")
+	}
+
+	var rules []asnRule
+
+	for i, ruleCfg := range cfg.Rules {
+		rule := asnRule{
+			asn: map[uint]bool{},
+		}
+
+		for _, n := range ruleCfg.ASN {
+			rule.asn[n] = true
+		}
+
+		for _, org := range ruleCfg.OrgContains {
+			rule.orgContains = append(rule.orgContains, strings.ToLower(org))
+		}
+
+		switch strings.ToLower(ruleCfg.Action) {
+		case asnActionWhitelist:
+			rule.decision = decisionWhitelist
+		case asnActionBlock:
+			rule.decision = decisionBan
+		case asnActionScore:
+			rule.decision = decisionNone
+			rule.score = harmScore(ruleCfg.Score)
+		default:
+			return nil, fmt.Errorf("rule %d: unknow action %q (supported: %s, %s, %s)", i, ruleCfg.Action, asnActionWhitelist, asnActionBlock, asnActionScore)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	if cfg.ReloadInterval == 0 {
+		cfg.ReloadInterval = defaultMMDBReloadInterval
+	}
+
+	db, err := newMMDBReader(cfg.Path, cfg.ReloadInterval)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load ASN database from %q: %w", cfg.Path, err)
+	}
+
+	log.Printf("ASN database loaded %q, %d rules", cfg.Path, len(rules))
+
+	return &asnChecker{
+		db:    db,
+		rules: rules,
+	}, nil
+}
+
+func (ac *asnChecker) Check(l *logLine) (harm harmScore, descision instantDecision) {
+	var rec asnRecord
+
+	err := ac.db.Lookup(l.IP(), &rec)
+	if err != nil {
+		log.Printf("cannot check ASN for %v: %v", l, err)
+		return 0, decisionNone
+	}
+
+	// IP is not found in database
+	if rec.Number == 0 {
+		return 0, decisionNone
+	}
+
+	l.Set(asnField, strconv.FormatUint(uint64(rec.Number), 10))
+	l.Set(asOrgField, rec.Organization)
+
+	org := strings.ToLower(rec.Organization)
+
+	for _, rule := range ac.rules {
+		if rule.match(rec.Number, org) {
+			return rule.score, rule.decision
+		}
+	}
+
+	return 0, decisionNone
+}
+
+func (ac *asnChecker) Close() error {
+	return ac.db.Close()
+}
+
+// match org must be in lower case
+func (r asnRule) match(asn uint, org string) bool {
+	if r.asn[asn] {
+		return true
+	}
+
+	for _, substr := range r.orgContains {
+		if strings.Contains(org, substr) {
+			return true
+		}
+	}
+
+	return false
+}
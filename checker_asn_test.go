@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_asnChecker_Check(t *testing.T) {
+	rules := []asnRuleConfig{
+		{
+			ASN:    []uint{15169},
+			Action: "whitelist",
+		},
+		{
+			OrgContains: []string{"hetzner", "ovh"},
+			Action:      "block",
+		},
+		{
+			ASN:    []uint{14061},
+			Action: "score",
+			Score:  3,
+		},
+	}
+
+	tests := []struct {
+		name         string
+		ip           net.IP
+		wantScore    harmScore
+		wantDecision instantDecision
+		wantASN      string
+		wantOrg      string
+	}{
+		{
+			name:         "whitelist by number",
+			ip:           net.ParseIP("66.249.66.1"),
+			wantDecision: decisionWhitelist,
+			wantASN:      "15169",
+			wantOrg:      "GOOGLE",
+		},
+		{
+			name:         "block by organisation",
+			ip:           net.ParseIP("51.38.1.2"),
+			wantDecision: decisionBan,
+			wantASN:      "16276",
+			wantOrg:      "OVH SAS",
+		},
+		{
+			name:         "block IPv6 by organisation",
+			ip:           net.ParseIP("2a01:4f8:1:2::1"),
+			wantDecision: decisionBan,
+			wantASN:      "24940",
+			wantOrg:      "Hetzner Online GmbH",
+		},
+		{
+			name:         "score",
+			ip:           net.ParseIP("167.99.10.10"),
+			wantScore:    3,
+			wantDecision: decisionNone,
+			wantASN:      "14061",
+			wantOrg:      "DIGITALOCEAN-ASN",
+		},
+		{
+			name:         "unknown",
+			ip:           net.ParseIP("1.2.3.4"),
+			wantDecision: decisionNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac, err := newASNChecker(asnCheckerConfig{
+				Path:  "test-data/geoip2-asn.mmdb",
+				Rules: rules,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ac.Close()
+
+			l := &logLine{ip: tt.ip, fields: map[string]string{}}
+
+			gotScore, gotDecision := ac.Check(l)
+			if gotScore != tt.wantScore {
+				t.Errorf("asnChecker.Check() gotScore = %v, want %v", gotScore, tt.wantScore)
+			}
+			if gotDecision != tt.wantDecision {
+				t.Errorf("asnChecker.Check() gotDecision = %v, want %v", gotDecision, tt.wantDecision)
+			}
+
+			if asn, _ := l.Get(asnField); asn != tt.wantASN {
+				t.Errorf("got asn %q, want %q", asn, tt.wantASN)
+			}
+
+			if org, _ := l.Get(asOrgField); org != tt.wantOrg {
+				t.Errorf("got as_org %q, want %q", org, tt.wantOrg)
+			}
+		})
+	}
+}
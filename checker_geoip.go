@@ -3,13 +3,32 @@ package main
 import (
 	_ "embed"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/oschwald/maxminddb-golang"
 	"github.com/vasyahuyasa/botassasin/log"
 )
 
-const countryField = "country"
+const (
+	countryField   = "country"
+	continentField = "continent"
+	regionField    = "region"
+	cityField      = "city"
+	accuracyField  = "accuracy_radius"
+	// country of IP missing in database
+	unknownCountry = "unknown"
+
+	geoIPModeAllow  = "allow"
+	geoIPModeBlock  = "block"
+	geoIPModeScore  = "score"
+	geoIPModeEnrich = "enrich"
+
+	geoIPUnknownNone      = "none"
+	geoIPUnknownWhitelist = "whitelist"
+	geoIPUnknownBlock     = "block"
+	geoIPUnknownScore     = "score"
+)
 
 //go:embed GeoLite2-Country.mmdb
 var embededGeoIP []byte
@@ -22,66 +41,202 @@ type geoIPRecord struct {
 	} `maxminddb:"country"`
 }
 
+// geoIPCityRecord is decoded only from City databases, only english
+// names are decoded
+type geoIPCityRecord struct {
+	geoIPRecord
+
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Subdivisions []struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names struct {
+			En string `maxminddb:"en"`
+		} `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		AccuracyRadius uint16 `maxminddb:"accuracy_radius"`
+	} `maxminddb:"location"`
+}
+
 type geoIPConfig struct {
-	Path             string   `yaml:"path"`
+	Path string `yaml:"path"`
+	// allowed countries are whitelisted, others are banned
 	AllowedCountries []string `yaml:"allowed_countries"`
+	// blocked countries are banned, others are checked by next checkers
+	BlockedCountries []string `yaml:"blocked_countries"`
+	// harm score added for country
+	CountryScores map[string]int `yaml:"country_scores"`
+	// action for IP without country: none, whitelist, block or score
+	UnknownAction string `yaml:"unknown_action"`
+	UnknownScore  int    `yaml:"unknown_score"`
+	// how often database file is checked for update
+	ReloadInterval time.Duration `yaml:"reload_interval"`
 }
 
 type geoIPChecker struct {
-	db               *maxminddb.Reader
-	allowedCountries []string
+	db *mmdbReader
+
+	// allow, block, score or enrich, countries is list for allow and
+	// block mode
+	mode      string
+	countries map[string]bool
+	scores    map[string]harmScore
+
+	unknownDecision instantDecision
+	unknownScore    harmScore
 }
 
 func newGeoIPChecker(cfg geoIPConfig) (*geoIPChecker, error) {
-	var db *maxminddb.Reader
-	var dbErr error
+	gi := &geoIPChecker{
+		mode:      geoIPModeEnrich,
+		countries: map[string]bool{},
+		scores:    map[string]harmScore{},
+	}
+
+	if len(cfg.AllowedCountries) > 0 && len(cfg.BlockedCountries) > 0 {
+		return nil, fmt.Errorf("allowed_countries and blocked_countries can't be used together")
+	}
+
+	var countries []string
+
+	switch {
+	case len(cfg.AllowedCountries) > 0:
+		gi.mode = geoIPModeAllow
+		countries = cfg.AllowedCountries
+
+		// backward compatible, IP without country is not allowed
+		gi.unknownDecision = decisionBan
+
+	case len(cfg.BlockedCountries) > 0:
+		gi.mode = geoIPModeBlock
+		countries = cfg.BlockedCountries
+
+	case len(cfg.CountryScores) > 0:
+		gi.mode = geoIPModeScore
+	}
+
+	for _, country := range countries {
+		gi.countries[strings.ToUpper(country)] = true
+	}
+
+	for country, score := range cfg.CountryScores {
+		gi.scores[strings.ToUpper(country)] = harmScore(score)
+	}
+
+	switch strings.ToLower(cfg.UnknownAction) {
+	case "":
+	case geoIPUnknownNone:
+		gi.unknownDecision = decisionNone
+	case geoIPUnknownWhitelist:
+		gi.unknownDecision = decisionWhitelist
+	case geoIPUnknownBlock:
+		gi.unknownDecision = decisionBan
+	case geoIPUnknownScore:
+		gi.unknownDecision = decisionNone
+		gi.unknownScore = harmScore(cfg.UnknownScore)
+	default:
+		return nil, fmt.Errorf("unknow unknown_action %q (supported: %s, %s, %s, %s)", cfg.UnknownAction, geoIPUnknownNone, geoIPUnknownWhitelist, geoIPUnknownBlock, geoIPUnknownScore)
+	}
+
+	if cfg.ReloadInterval == 0 {
+		cfg.ReloadInterval = defaultMMDBReloadInterval
+	}
+
+	var db *mmdbReader
 	var err error
 
 	if cfg.Path == "" {
-		db, dbErr = maxminddb.FromBytes(embededGeoIP)
-		if dbErr != nil {
-			err = fmt.Errorf("cannot load GeoIP database from %q: %w", cfg.Path, dbErr)
+		db, err = newMMDBReaderFromBytes(embededGeoIP)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load embeded GeoIP database: %w", err)
 		}
 	} else {
-		db, dbErr = maxminddb.Open(cfg.Path)
-		if dbErr != nil {
-			err = fmt.Errorf("cannot load embeded GeoIP database: %w", dbErr)
+		db, err = newMMDBReader(cfg.Path, cfg.ReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load GeoIP database from %q: %w", cfg.Path, err)
 		}
 	}
 
-	if err != nil {
-		return nil, err
-	}
-
-	dbPath := "embeded"
-	if cfg.Path != "" {
-		dbPath = cfg.Path
-	}
+	gi.db = db
 
-	log.Printf("geoIP loaded %q, allow countries %s", dbPath, strings.Join(cfg.AllowedCountries, ","))
+	log.Printf("geoIP loaded %q (build %s), mode %s, countries %s, scores %v, unknown %s", db.path, db.BuildTime().Format(time.RFC3339), gi.mode, strings.Join(countries, ","), cfg.CountryScores, gi.unknownDecision)
 
-	return &geoIPChecker{
-		db:               db,
-		allowedCountries: cfg.AllowedCountries,
-	}, nil
+	return gi, nil
 }
 
 func (gi *geoIPChecker) Check(l *logLine) (score harmScore, decision instantDecision) {
-	var rec geoIPRecord
-
-	err := gi.db.Lookup(l.IP(), &rec)
+	rec, err := gi.lookup(l)
 	if err != nil {
 		log.Printf("cannot check country for %v: %v", l, err)
 		return 0, decisionNone
 	}
 
+	// private ranges and IPs missing in database
+	if rec.Country.ISOCode == "" {
+		l.Set(countryField, unknownCountry)
+		return gi.unknownScore, gi.unknownDecision
+	}
+
 	l.Set(countryField, rec.Country.ISOCode)
 
-	for _, allowed := range gi.allowedCountries {
-		if rec.Country.ISOCode == allowed {
+	score = gi.scores[rec.Country.ISOCode]
+
+	switch gi.mode {
+	case geoIPModeAllow:
+		if gi.countries[rec.Country.ISOCode] {
 			return 0, decisionWhitelist
 		}
+
+		return 0, decisionBan
+
+	case geoIPModeBlock:
+		if gi.countries[rec.Country.ISOCode] {
+			return 0, decisionBan
+		}
 	}
 
-	return 0, decisionBan
+	return score, decisionNone
+}
+
+// lookup return country and set city fields if database is City database
+func (gi *geoIPChecker) lookup(l *logLine) (geoIPRecord, error) {
+	if !gi.db.IsCity() {
+		var rec geoIPRecord
+		err := gi.db.Lookup(l.IP(), &rec)
+
+		return rec, err
+	}
+
+	var rec geoIPCityRecord
+
+	err := gi.db.Lookup(l.IP(), &rec)
+	if err != nil {
+		return geoIPRecord{}, err
+	}
+
+	region := ""
+	if len(rec.Subdivisions) > 0 && rec.Subdivisions[0].ISOCode != "" {
+		// ISO 3166-2 code, ex. RU-MOW
+		region = rec.Country.ISOCode + "-" + rec.Subdivisions[0].ISOCode
+	}
+
+	accuracy := ""
+	if rec.Location.AccuracyRadius > 0 {
+		accuracy = strconv.Itoa(int(rec.Location.AccuracyRadius))
+	}
+
+	l.Set(continentField, rec.Continent.Code)
+	l.Set(regionField, region)
+	l.Set(cityField, rec.City.Names.En)
+	l.Set(accuracyField, accuracy)
+
+	return rec.geoIPRecord, nil
+}
+
+func (gi *geoIPChecker) Close() error {
+	return gi.db.Close()
 }
@@ -53,6 +53,100 @@ func Test_geoIPChecker_Check(t *testing.T) {
 			wantScore:    0,
 			wantDecision: decisionBan,
 		},
+		{
+			name: "blocked country",
+			cfg: geoIPConfig{
+				Path:             "test-data/geoip2-country.mmdb",
+				BlockedCountries: []string{"cn"},
+			},
+			logLine: logLine{
+				ip:     net.IPv4(128, 1, 51, 210),
+				fields: map[string]string{},
+			},
+			wantScore:    0,
+			wantDecision: decisionBan,
+		},
+		{
+			name: "not blocked country",
+			cfg: geoIPConfig{
+				Path:             "test-data/geoip2-country.mmdb",
+				BlockedCountries: []string{"CN"},
+				CountryScores:    map[string]int{"FR": 2},
+			},
+			logLine: logLine{
+				ip:     net.IPv4(192, 229, 221, 103),
+				fields: map[string]string{},
+			},
+			wantScore:    2,
+			wantDecision: decisionNone,
+		},
+		{
+			name: "unknown in block mode",
+			cfg: geoIPConfig{
+				Path:             "test-data/geoip2-country.mmdb",
+				BlockedCountries: []string{"CN"},
+			},
+			logLine: logLine{
+				ip:     net.IPv4(1, 2, 3, 4),
+				fields: map[string]string{},
+			},
+			wantScore:    0,
+			wantDecision: decisionNone,
+		},
+		{
+			name: "country score",
+			cfg: geoIPConfig{
+				Path:          "test-data/geoip2-country.mmdb",
+				CountryScores: map[string]int{"CN": 3, "RU": 1},
+			},
+			logLine: logLine{
+				ip:     net.IPv4(128, 1, 51, 210),
+				fields: map[string]string{},
+			},
+			wantScore:    3,
+			wantDecision: decisionNone,
+		},
+		{
+			name: "unknown score",
+			cfg: geoIPConfig{
+				Path:          "test-data/geoip2-country.mmdb",
+				CountryScores: map[string]int{"CN": 3},
+				UnknownAction: "score",
+				UnknownScore:  1,
+			},
+			logLine: logLine{
+				ip:     net.IPv4(10, 0, 0, 1),
+				fields: map[string]string{},
+			},
+			wantScore:    1,
+			wantDecision: decisionNone,
+		},
+		{
+			name: "unknown whitelist in allow mode",
+			cfg: geoIPConfig{
+				Path:             "test-data/geoip2-country.mmdb",
+				AllowedCountries: []string{"RU"},
+				UnknownAction:    "whitelist",
+			},
+			logLine: logLine{
+				ip:     net.IPv4(10, 0, 0, 1),
+				fields: map[string]string{},
+			},
+			wantScore:    0,
+			wantDecision: decisionWhitelist,
+		},
+		{
+			name: "enrich only",
+			cfg: geoIPConfig{
+				Path: "test-data/geoip2-country.mmdb",
+			},
+			logLine: logLine{
+				ip:     net.IPv4(95, 173, 136, 72),
+				fields: map[string]string{},
+			},
+			wantScore:    0,
+			wantDecision: decisionNone,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -68,6 +162,84 @@ func Test_geoIPChecker_Check(t *testing.T) {
 			if gotDecision != tt.wantDecision {
 				t.Errorf("geoIPChecker.Check() gotDecision = %v, want %v", gotDecision, tt.wantDecision)
 			}
+
+			if _, ok := tt.logLine.Get(countryField); !ok {
+				t.Errorf("country field is not set")
+			}
+		})
+	}
+}
+
+func Test_newGeoIPChecker_conflict(t *testing.T) {
+	_, err := newGeoIPChecker(geoIPConfig{
+		Path:             "test-data/geoip2-country.mmdb",
+		AllowedCountries: []string{"RU"},
+		BlockedCountries: []string{"CN"},
+	})
+	if err == nil {
+		t.Error("newGeoIPChecker() expected error for allowed_countries with blocked_countries")
+	}
+}
+
+func Test_geoIPChecker_Check_city(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   net.IP
+		want map[string]string
+	}{
+		{
+			name: "city",
+			ip:   net.IPv4(95, 173, 136, 72),
+			want: map[string]string{
+				countryField:   "RU",
+				continentField: "EU",
+				regionField:    "RU-MOW",
+				cityField:      "Moscow",
+				accuracyField:  "20",
+			},
+		},
+		{
+			name: "country without city",
+			ip:   net.IPv4(128, 1, 51, 210),
+			want: map[string]string{
+				countryField:   "CN",
+				continentField: "AS",
+				regionField:    "",
+				cityField:      "",
+				accuracyField:  "1000",
+			},
+		},
+		{
+			name: "IPv6",
+			ip:   net.ParseIP("2001:db8::1"),
+			want: map[string]string{
+				countryField:   "US",
+				continentField: "NA",
+				regionField:    "US-CA",
+				cityField:      "Los Angeles",
+				accuracyField:  "100",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gi, err := newGeoIPChecker(geoIPConfig{
+				Path:             "test-data/geoip2-city.mmdb",
+				BlockedCountries: []string{"CN"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer gi.Close()
+
+			l := &logLine{ip: tt.ip, fields: map[string]string{}}
+			gi.Check(l)
+
+			for field, want := range tt.want {
+				if got, _ := l.Get(field); got != want {
+					t.Errorf("got %s %q, want %q", field, got, want)
+				}
+			}
 		})
 	}
 }
@@ -9,7 +9,9 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/vasyahuyasa/botassasin/log"
@@ -34,8 +36,6 @@ var (
 	}
 
 	_ checker = &listChecker{}
-
-	ipMaskFull = net.IPMask{0xff, 0xff, 0xff, 0xff}
 )
 
 type listCheckerAction int
@@ -45,10 +45,25 @@ type listCheckerSrcConfig struct {
 	Type             string   `yaml:"type"`
 	Action           string   `yaml:"action"`
 	AwsServiceFilter []string `yaml:"aws_service_filter"`
+	// filters of formats with services and regions, empty means all
+	ServiceFilter []string `yaml:"service_filter"`
+	RegionFilter  []string `yaml:"region_filter"`
+	// columns of csv by header name or number starting from 0
+	CSVColumn        string `yaml:"csv_column"`
+	CSVServiceColumn string `yaml:"csv_service_column"`
+	CSVRegionColumn  string `yaml:"csv_region_column"`
+	// default is comma
+	CSVSeparator string `yaml:"csv_separator"`
+	// zero means source is loaded only on start
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// list older than max staleness is not used, zero means no limit
+	MaxStaleness time.Duration `yaml:"max_staleness"`
 }
 
 type listCheckerConfig struct {
 	Sources []listCheckerSrcConfig
+	// directory for copies of remote lists, empty means no cache
+	CacheDir string `yaml:"cache_dir"`
 }
 
 // ipList naive ip map implementation with stdlib net.IPNet
@@ -66,18 +81,48 @@ type ipList2 struct {
 }
 
 // ipList3 ip map implementation with netipx.IPSet package
-// most perfomant at the momnet
+// most perfomant at the momnet, used by listChecker
 type ipList3 struct {
 	ipset  *netipx.IPSet
 	action listCheckerAction
 }
 
+// listSource prefixes loaded from one source, prefixes are replaced on refresh
+type listSource struct {
+	cfg    listCheckerSrcConfig
+	action listCheckerAction
+	// nil for local files or if cache is disabled
+	cache *listCache
+
+	// guarded by listChecker mutex
+	prefixes []netip.Prefix
+	// when prefixes were received from source
+	fetchedAt time.Time
+}
+
+// listChecker prefixes of all sources are merged to one set per action,
+// whitelist is checked first
 type listChecker struct {
-	lists []ipList
+	sources []*listSource
+
+	mu    *sync.RWMutex
+	lists []ipList3
+
+	stop chan struct{}
 }
 
 func newListChecker(cfg listCheckerConfig) (*listChecker, error) {
-	var lists []ipList
+	if cfg.CacheDir != "" {
+		err := os.MkdirAll(cfg.CacheDir, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create list cache directory: %w", err)
+		}
+	}
+
+	c := &listChecker{
+		mu:   &sync.RWMutex{},
+		stop: make(chan struct{}),
+	}
 
 	for _, srcCfg := range cfg.Sources {
 		action, ok := listCheckerActionMap[srcCfg.Action]
@@ -85,46 +130,69 @@ func newListChecker(cfg listCheckerConfig) (*listChecker, error) {
 			return nil, fmt.Errorf("unknow action %q (supported: whitelist, block)", srcCfg.Action)
 		}
 
-		data, err := bytesFromSrc(srcCfg.Src)
+		if _, ok := listParsers[srcCfg.Type]; !ok {
+			return nil, fmt.Errorf("unknown source type %q (supported types %v)", srcCfg.Type, listSrcTypes())
+		}
+
+		err := validateListSource(srcCfg)
 		if err != nil {
-			return nil, fmt.Errorf("cannot get %s list %q: %w", srcCfg.Type, srcCfg.Src, err)
+			return nil, fmt.Errorf("invalid %s list %q: %w", srcCfg.Type, srcCfg.Src, err)
 		}
 
-		switch srcCfg.Type {
-		case listCheckerSrcTypeTxt:
-			ips := parseTxt(data)
-			lists = append(lists, ipList{
-				ips:    ips,
-				action: action,
-			})
-			log.Printf("list %s (%s) created with %d rules action = %s", srcCfg.Type, srcCfg.Src, len(ips), srcCfg.Action)
-
-		case listCheckerSrcTypeAWSIpRanges:
-			ips, err := parseAWSIpRanges(data, srcCfg.AwsServiceFilter)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse aws_ip_ranges: %w", err)
-			}
-			lists = append(lists, ipList{
-				ips:    ips,
-				action: action,
-			})
-			log.Printf("list %s (%s) created with %d rules action = %s filter = %v", srcCfg.Type, srcCfg.Src, len(ips), srcCfg.Action, srcCfg.AwsServiceFilter)
-
-		default:
-			return nil, fmt.Errorf("unknown source type %q (supported types %v)", srcCfg.Type, []string{listCheckerSrcTypeTxt, listCheckerSrcTypeAWSIpRanges})
+		src := &listSource{
+			cfg:    srcCfg,
+			action: action,
 		}
 
+		if cfg.CacheDir != "" && isRemoteSrc(srcCfg.Src) {
+			src.cache = newListCache(cfg.CacheDir, srcCfg.Src, srcCfg.MaxStaleness)
+		}
+
+		prefixes, fetchedAt, err := src.load()
+		if err != nil {
+			return nil, err
+		}
+
+		src.prefixes = prefixes
+		src.fetchedAt = fetchedAt
+		src.reportLoaded()
+
+		c.sources = append(c.sources, src)
+	}
+
+	err := c.rebuild()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, src := range c.sources {
+		if src.cfg.RefreshInterval > 0 {
+			go c.refresher(src, c.stop)
+		}
+
+		// list can become stale without refresh or if it is loaded from
+		// old cache
+		if src.cfg.MaxStaleness > 0 {
+			go c.staleWatcher(src, c.stop)
+		}
 	}
 
-	return &listChecker{
-		lists: lists,
-	}, nil
+	return c, nil
 }
 
 func (c *listChecker) Check(l *logLine) (score harmScore, descision instantDecision) {
-	for _, list := range c.lists {
-		if list.contains(l.IP()) {
-			if list.action == listCheckerActionWhitelist {
+	// IPv4-mapped IPv6 addresses are unmapped
+	addr, ok := netipx.FromStdIP(l.IP())
+	if !ok {
+		return 0, decisionNone
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for i := range c.lists {
+		if c.lists[i].contains(addr) {
+			if c.lists[i].action == listCheckerActionWhitelist {
 				return 0, decisionWhitelist
 			}
 
@@ -135,6 +203,208 @@ func (c *listChecker) Check(l *logLine) (score harmScore, descision instantDecis
 	return 0, decisionNone
 }
 
+// loaded return true if prefixes of any source are loaded and not stale
+func (c *listChecker) loaded() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, src := range c.sources {
+		if src.prefixes != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Close stop refresh of sources
+func (c *listChecker) Close() error {
+	close(c.stop)
+
+	return nil
+}
+
+// rebuild merge prefixes of sources to sets, must be called with locked mutex
+func (c *listChecker) rebuild() error {
+	var lists []ipList3
+
+	for _, action := range []listCheckerAction{listCheckerActionWhitelist, listCheckerActionBlock} {
+		var b netipx.IPSetBuilder
+
+		for _, src := range c.sources {
+			if src.action != action {
+				continue
+			}
+
+			for _, prefix := range src.prefixes {
+				b.AddPrefix(prefix)
+			}
+		}
+
+		ipset, err := b.IPSet()
+		if err != nil {
+			return fmt.Errorf("cannot build IP set: %w", err)
+		}
+
+		lists = append(lists, ipList3{
+			ipset:  ipset,
+			action: action,
+		})
+	}
+
+	c.lists = lists
+
+	return nil
+}
+
+// replace prefixes of source, prefixes of other sources are not changed
+func (c *listChecker) replace(src *listSource, prefixes []netip.Prefix, fetchedAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldPrefixes, oldFetchedAt := src.prefixes, src.fetchedAt
+	src.prefixes, src.fetchedAt = prefixes, fetchedAt
+
+	err := c.rebuild()
+	if err != nil {
+		src.prefixes, src.fetchedAt = oldPrefixes, oldFetchedAt
+		return err
+	}
+
+	src.reportLoaded()
+
+	return nil
+}
+
+// dropStale remove prefixes of source if they are older than max staleness
+func (c *listChecker) dropStale(src *listSource, now time.Time) {
+	if src.cfg.MaxStaleness == 0 {
+		return
+	}
+
+	c.mu.RLock()
+	stale := src.prefixes != nil && now.Sub(src.fetchedAt) > src.cfg.MaxStaleness
+	fetchedAt := src.fetchedAt
+	c.mu.RUnlock()
+
+	if !stale {
+		return
+	}
+
+	err := c.replace(src, nil, fetchedAt)
+	if err != nil {
+		log.Printf("cannot drop stale list: %v", err)
+		return
+	}
+
+	log.Printf("list %s (%s) fetched at %s is stale and not used", src.cfg.Type, src.cfg.Src, fetchedAt.Format(time.RFC3339))
+}
+
+func (c *listChecker) refresher(src *listSource, stop <-chan struct{}) {
+	ticker := time.NewTicker(src.cfg.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		prefixes, fetchedAt, err := src.load()
+		if err == nil {
+			err = c.replace(src, prefixes, fetchedAt)
+		}
+
+		if err != nil {
+			// last successfully loaded list is kept until it become stale
+			log.Printf("cannot refresh list: %v", err)
+		}
+	}
+}
+
+// staleWatcher drop prefixes of source when they become stale
+func (c *listChecker) staleWatcher(src *listSource, stop <-chan struct{}) {
+	timer := time.NewTimer(c.untilStale(src, time.Now()))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		now := time.Now()
+
+		c.dropStale(src, now)
+		timer.Reset(c.untilStale(src, now))
+	}
+}
+
+// untilStale return time until prefixes of source become stale, source
+// without prefixes is checked again after max staleness
+func (c *listChecker) untilStale(src *listSource, now time.Time) time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if src.prefixes == nil {
+		return src.cfg.MaxStaleness
+	}
+
+	return src.fetchedAt.Add(src.cfg.MaxStaleness).Sub(now)
+}
+
+// load fetch and parse source
+func (src *listSource) load() ([]netip.Prefix, time.Time, error) {
+	data, fetchedAt, err := src.fetch()
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cannot get %s list %q: %w", src.cfg.Type, src.cfg.Src, err)
+	}
+
+	prefixes, err := listParsers[src.cfg.Type](data, src.cfg)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("cannot parse %s list %q: %w", src.cfg.Type, src.cfg.Src, err)
+	}
+
+	log.Printf("list %s (%s) loaded with %d rules action = %s%s", src.cfg.Type, src.cfg.Src, len(prefixes), src.cfg.Action, src.filtersString())
+
+	return prefixes, fetchedAt, nil
+}
+
+func (src *listSource) filtersString() string {
+	var str string
+
+	if len(src.cfg.AwsServiceFilter) > 0 {
+		str += fmt.Sprintf(" filter = %v", src.cfg.AwsServiceFilter)
+	}
+
+	if len(src.cfg.ServiceFilter) > 0 {
+		str += fmt.Sprintf(" service filter = %v", src.cfg.ServiceFilter)
+	}
+
+	if len(src.cfg.RegionFilter) > 0 {
+		str += fmt.Sprintf(" region filter = %v", src.cfg.RegionFilter)
+	}
+
+	return str
+}
+
+func (src *listSource) fetch() ([]byte, time.Time, error) {
+	if src.cache != nil {
+		return src.cache.fetch(src.cfg.Src)
+	}
+
+	data, err := bytesFromSrc(src.cfg.Src)
+
+	return data, time.Now(), err
+}
+
+func (src *listSource) reportLoaded() {
+	listRefreshGauge.WithLabelValues(src.cfg.Src).Set(float64(src.fetchedAt.Unix()))
+	listEntriesGauge.WithLabelValues(src.cfg.Src).Set(float64(len(src.prefixes)))
+}
+
 func (list *ipList) contains(ip net.IP) bool {
 	for _, ipnet := range list.ips {
 		if ipnet.Contains(ip) {
@@ -155,11 +425,13 @@ func (list *ipList3) contains(ip netip.Addr) bool {
 	return list.ipset.Contains(ip)
 }
 
-func bytesFromSrc(src string) ([]byte, error) {
-	// TODO: file cache
+func isRemoteSrc(src string) bool {
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://")
+}
 
+func bytesFromSrc(src string) ([]byte, error) {
 	// read file over network
-	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+	if isRemoteSrc(src) {
 		client := http.Client{
 			Timeout: httpRequestTimeout,
 		}
@@ -170,6 +442,10 @@ func bytesFromSrc(src string) ([]byte, error) {
 
 		defer res.Body.Close()
 
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET query to %q response status %s", src, res.Status)
+		}
+
 		data, err := ioutil.ReadAll(res.Body)
 		if err != nil {
 			return nil, fmt.Errorf("cannot read from %q: %w", src, err)
@@ -187,34 +463,46 @@ func bytesFromSrc(src string) ([]byte, error) {
 	return data, nil
 }
 
-func parseTxt(data []byte) []*net.IPNet {
+func parseTxt(data []byte) []netip.Prefix {
 	scanner := bufio.NewScanner(bytes.NewBuffer(data))
 
-	var ips []*net.IPNet
+	var prefixes []netip.Prefix
 
 	for scanner.Scan() {
 		// remove comments and trim
 		str := strings.TrimSpace(strings.Split(scanner.Text(), "#")[0])
+		if str == "" {
+			continue
+		}
 
-		ipnet, err := parseIPorCIDR(str)
+		prefix, err := parseIPorCIDR(str)
 		if err != nil {
 			log.Printf("cannot parse %q: %v", str, err)
 			continue
 		}
 
-		ips = append(ips, ipnet)
+		prefixes = append(prefixes, prefix)
 	}
 
-	return ips
+	return prefixes
 }
 
-func parseAWSIpRanges(data []byte, filter []string) ([]*net.IPNet, error) {
+// parseAWSIpRanges IP prefix must match service filter, so unlike other
+// formats empty service filter match nothing, empty region filter match all
+// regions
+func parseAWSIpRanges(data []byte, serviceFilter []string, regionFilter []string) ([]netip.Prefix, error) {
 	// some field are ommited
 	type awsIpRanges struct {
 		Prefixes []struct {
 			IpPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
 			Service  string `json:"service"`
 		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
 	}
 
 	var ranges awsIpRanges
@@ -224,21 +512,21 @@ func parseAWSIpRanges(data []byte, filter []string) ([]*net.IPNet, error) {
 		return nil, fmt.Errorf("cannot unmarshal aws ip range data: %w", err)
 	}
 
-	var ips []*net.IPNet
+	var strs []string
 
 	for _, r := range ranges.Prefixes {
-		if strInSlice(r.Service, filter) {
-			ipnet, err := parseIPorCIDR(r.IpPrefix)
-			if err != nil {
-				log.Printf("cannot parse %q: %v", r.IpPrefix, err)
-				continue
-			}
+		if strInSlice(r.Service, serviceFilter) && matchFilter(r.Region, regionFilter) {
+			strs = append(strs, r.IpPrefix)
+		}
+	}
 
-			ips = append(ips, ipnet)
+	for _, r := range ranges.IPv6Prefixes {
+		if strInSlice(r.Service, serviceFilter) && matchFilter(r.Region, regionFilter) {
+			strs = append(strs, r.IPv6Prefix)
 		}
 	}
 
-	return ips, nil
+	return parsePrefixes(strs), nil
 }
 
 func strInSlice(str string, all []string) bool {
@@ -251,13 +539,35 @@ func strInSlice(str string, all []string) bool {
 	return false
 }
 
-func parseIPorCIDR(ip string) (*net.IPNet, error) {
-	if strings.IndexByte(ip, '/') != -1 {
-		_, ipNet, err := net.ParseCIDR(ip)
-		return ipNet, err
+// parseIPorCIDR parse IPv4 or IPv6 address or network, IPv4-mapped IPv6
+// are converted to IPv4
+func parseIPorCIDR(str string) (netip.Prefix, error) {
+	if strings.IndexByte(str, '/') == -1 {
+		addr, err := netip.ParseAddr(str)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		addr = addr.Unmap()
+
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(str)
+	if err != nil {
+		return netip.Prefix{}, err
 	}
 
-	ip4 := net.ParseIP(ip)
+	addr := prefix.Addr()
+
+	if addr.Is4In6() {
+		if prefix.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("IPv4-mapped prefix %q is shorter than /96", str)
+		}
+
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
 
-	return &net.IPNet{IP: ip4, Mask: ipMaskFull}, nil
+	// host bits are ignored like in net.ParseCIDR
+	return prefix.Masked(), nil
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
 	"net"
 	"net/netip"
+	"sync"
 	"testing"
 
 	"github.com/yl2chen/cidranger"
@@ -73,6 +76,60 @@ func BenchmarkIpList3In(b *testing.B) {
 	}
 }
 
+// BenchmarkListCheckerCheck lookup time must not grow with size of list
+func BenchmarkListCheckerCheck(b *testing.B) {
+	for _, size := range []int{1000, 10000, 100000, 200000} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			c := &listChecker{
+				mu: &sync.RWMutex{},
+				sources: []*listSource{
+					{
+						action:   listCheckerActionBlock,
+						prefixes: benchmarkPrefixes(size),
+					},
+				},
+			}
+
+			err := c.rebuild()
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			lines := []*logLine{
+				{ip: net.IPv4(20, 20, 101, 202)},
+				{ip: net.ParseIP("2001:db8::1")},
+			}
+
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				c.Check(lines[n%len(lines)])
+			}
+		})
+	}
+}
+
+// benchmarkPrefixes random IPv4 /24 and IPv6 /48 networks, half of each
+func benchmarkPrefixes(n int) []netip.Prefix {
+	r := rand.New(rand.NewSource(1))
+	prefixes := make([]netip.Prefix, 0, n)
+
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			var a [4]byte
+			r.Read(a[:3])
+			prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom4(a), 24))
+			continue
+		}
+
+		var a [16]byte
+		r.Read(a[:6])
+		prefixes = append(prefixes, netip.PrefixFrom(netip.AddrFrom16(a), 48))
+	}
+
+	return prefixes
+}
+
 func benchmarkIpListDataProvider() []*net.IPNet {
 	return []*net.IPNet{
 		{
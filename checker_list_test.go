@@ -7,7 +7,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 const ipFileContent = `1.2.3.4
@@ -225,6 +228,110 @@ func Test_listChecker_Check_File(t *testing.T) {
 			wantScore:     0,
 			wantDescision: decisionBan,
 		},
+		{
+			name: "AWS IPv6 block",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src: makeFile(t, `{
+							"syncToken": "1624792453",
+							"createDate": "2021-06-27-11-14-13",
+							"prefixes": [],
+							"ipv6_prefixes": [
+								{
+									"ipv6_prefix": "2600:1f14::/35",
+									"region": "us-west-2",
+									"service": "EC2",
+									"network_border_group": "us-west-2"
+								}
+							]
+						}`),
+						Type:             "aws_ip_ranges",
+						AwsServiceFilter: []string{"EC2"},
+						Action:           "block",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.ParseIP("2600:1f14:abc::1"),
+			},
+			wantScore:     0,
+			wantDescision: decisionBan,
+		},
+		{
+			name: "text IPv6 ban",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src: makeFile(t, `2001:db8::/32
+						2a01:4f8::1`),
+						Type:   "txt",
+						Action: "block",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.ParseIP("2a01:4f8::1"),
+			},
+			wantScore:     0,
+			wantDescision: decisionBan,
+		},
+		{
+			name: "text IPv4-mapped ban",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src:    makeFile(t, `::ffff:123.123.0.0/112`),
+						Type:   "txt",
+						Action: "block",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.IPv4(123, 123, 123, 123),
+			},
+			wantScore:     0,
+			wantDescision: decisionBan,
+		},
+		{
+			name: "IPv6 not match IPv4 network",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src:    makeFile(t, `0.0.0.0/0`),
+						Type:   "txt",
+						Action: "block",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.ParseIP("2001:db8::1"),
+			},
+			wantScore:     0,
+			wantDescision: decisionNone,
+		},
+		{
+			name: "whitelist before block",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src:    makeFile(t, `123.123.0.0/16`),
+						Type:   "txt",
+						Action: "block",
+					},
+					{
+						Src:    makeFile(t, `123.123.123.123`),
+						Type:   "txt",
+						Action: "whitelist",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.IPv4(123, 123, 123, 123),
+			},
+			wantScore:     0,
+			wantDescision: decisionWhitelist,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -589,6 +696,110 @@ func Test_listChecker_Check_Webserver(t *testing.T) {
 			wantScore:     0,
 			wantDescision: decisionBan,
 		},
+		{
+			name: "AWS IPv6 block",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src: makeWebserver(t, `{
+							"syncToken": "1624792453",
+							"createDate": "2021-06-27-11-14-13",
+							"prefixes": [],
+							"ipv6_prefixes": [
+								{
+									"ipv6_prefix": "2600:1f14::/35",
+									"region": "us-west-2",
+									"service": "EC2",
+									"network_border_group": "us-west-2"
+								}
+							]
+						}`),
+						Type:             "aws_ip_ranges",
+						AwsServiceFilter: []string{"EC2"},
+						Action:           "block",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.ParseIP("2600:1f14:abc::1"),
+			},
+			wantScore:     0,
+			wantDescision: decisionBan,
+		},
+		{
+			name: "text IPv6 ban",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src: makeWebserver(t, `2001:db8::/32
+						2a01:4f8::1`),
+						Type:   "txt",
+						Action: "block",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.ParseIP("2a01:4f8::1"),
+			},
+			wantScore:     0,
+			wantDescision: decisionBan,
+		},
+		{
+			name: "text IPv4-mapped ban",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src:    makeWebserver(t, `::ffff:123.123.0.0/112`),
+						Type:   "txt",
+						Action: "block",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.IPv4(123, 123, 123, 123),
+			},
+			wantScore:     0,
+			wantDescision: decisionBan,
+		},
+		{
+			name: "IPv6 not match IPv4 network",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src:    makeWebserver(t, `0.0.0.0/0`),
+						Type:   "txt",
+						Action: "block",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.ParseIP("2001:db8::1"),
+			},
+			wantScore:     0,
+			wantDescision: decisionNone,
+		},
+		{
+			name: "whitelist before block",
+			config: listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src:    makeWebserver(t, `123.123.0.0/16`),
+						Type:   "txt",
+						Action: "block",
+					},
+					{
+						Src:    makeWebserver(t, `123.123.123.123`),
+						Type:   "txt",
+						Action: "whitelist",
+					},
+				},
+			},
+			logLine: logLine{
+				ip: net.IPv4(123, 123, 123, 123),
+			},
+			wantScore:     0,
+			wantDescision: decisionWhitelist,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -658,3 +869,159 @@ func tmpFileCreator() (clear func(), factory func(t *testing.T, content string)
 			return fname
 		}
 }
+
+func Test_listChecker_refresh(t *testing.T) {
+	var mu sync.Mutex
+	content := "1.1.1.1\n"
+	status := http.StatusOK
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.WriteHeader(status)
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	set := func(newContent string, newStatus int) {
+		mu.Lock()
+		content, status = newContent, newStatus
+		mu.Unlock()
+	}
+
+	checker, err := newListChecker(listCheckerConfig{
+		Sources: []listCheckerSrcConfig{
+			{
+				Src:             srv.URL,
+				Type:            listCheckerSrcTypeTxt,
+				Action:          "block",
+				RefreshInterval: time.Millisecond * 10,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer checker.Close()
+
+	check := func(ip string) instantDecision {
+		_, decision := checker.Check(&logLine{ip: net.ParseIP(ip)})
+		return decision
+	}
+
+	waitFor := func(ip string, want instantDecision) {
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second * 5)
+		for check(ip) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Check(%s) = %v, want %v", ip, check(ip), want)
+			}
+
+			time.Sleep(time.Millisecond * 5)
+		}
+	}
+
+	if got := check("1.1.1.1"); got != decisionBan {
+		t.Fatalf("Check() = %v, want %v", got, decisionBan)
+	}
+
+	set("2.2.2.2\n", http.StatusOK)
+
+	waitFor("2.2.2.2", decisionBan)
+	waitFor("1.1.1.1", decisionNone)
+
+	// failed fetch keep last good list
+	set("", http.StatusInternalServerError)
+
+	time.Sleep(time.Millisecond * 50)
+
+	if got := check("2.2.2.2"); got != decisionBan {
+		t.Fatalf("Check() after failed refresh = %v, want %v", got, decisionBan)
+	}
+}
+
+func Test_listChecker_staleWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "list.txt")
+
+	err := ioutil.WriteFile(path, []byte("1.1.1.1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		refreshInterval time.Duration
+	}{
+		{
+			name: "without refresh",
+		},
+		{
+			name:            "refresh later than max staleness",
+			refreshInterval: time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker, err := newListChecker(listCheckerConfig{
+				Sources: []listCheckerSrcConfig{
+					{
+						Src:             path,
+						Type:            listCheckerSrcTypeTxt,
+						Action:          "block",
+						RefreshInterval: tt.refreshInterval,
+						MaxStaleness:    time.Millisecond * 50,
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer checker.Close()
+
+			if _, got := checker.Check(&logLine{ip: net.ParseIP("1.1.1.1")}); got != decisionBan {
+				t.Fatalf("Check() = %v, want %v", got, decisionBan)
+			}
+
+			time.Sleep(time.Millisecond * 200)
+
+			if _, got := checker.Check(&logLine{ip: net.ParseIP("1.1.1.1")}); got != decisionNone {
+				t.Fatalf("Check() of stale list = %v, want %v", got, decisionNone)
+			}
+		})
+	}
+}
+
+func Test_parseIPorCIDR(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    string
+		wantErr bool
+	}{
+		{str: "1.2.3.4", want: "1.2.3.4/32"},
+		{str: "1.2.3.4/24", want: "1.2.3.0/24"},
+		{str: "2001:db8::1", want: "2001:db8::1/128"},
+		{str: "2001:db8::1/32", want: "2001:db8::/32"},
+		{str: "::ffff:1.2.3.4", want: "1.2.3.4/32"},
+		{str: "::ffff:1.2.3.0/120", want: "1.2.3.0/24"},
+		{str: "::ffff:0.0.0.0/64", wantErr: true},
+		{str: "1.2.3", wantErr: true},
+		{str: "1.2.3.4/33", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			got, err := parseIPorCIDR(tt.str)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIPorCIDR() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil && got.String() != tt.want {
+				t.Errorf("parseIPorCIDR() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
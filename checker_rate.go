@@ -0,0 +1,348 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	rateField = "rate"
+
+	rateActionBlock = "block"
+	rateActionScore = "score"
+
+	defaultRateMaxEntries = 100000
+	defaultIPv4Prefix     = 24
+	defaultIPv6Prefix     = 64
+	defaultRateScore      = 1
+	rateJanitorInterval   = time.Minute
+)
+
+var _ checker = &rateChecker{}
+
+type rateWindowConfig struct {
+	Duration time.Duration `yaml:"duration"`
+	// IP exceed window when it has more than limit requests in duration
+	Limit int `yaml:"limit"`
+}
+
+type rateCheckerConfig struct {
+	Windows []rateWindowConfig `yaml:"windows"`
+	// only lines with field matching regex are counted
+	FieldName string `yaml:"field_name"`
+	Match     string `yaml:"match"`
+	// block (default) or score
+	Action     string `yaml:"action"`
+	Score      int    `yaml:"score"`
+	MaxEntries int    `yaml:"max_entries"`
+}
+
+// subnetRateCheckerConfig count requests by subnet instead of IP
+type subnetRateCheckerConfig struct {
+	Rate       rateCheckerConfig `yaml:",inline"`
+	IPv4Prefix int               `yaml:"ipv4_prefix"`
+	IPv6Prefix int               `yaml:"ipv6_prefix"`
+}
+
+// rateCounter sliding window counter, requests of previous fixed window
+// are weighted by part of it overlapping sliding window
+type rateCounter struct {
+	start time.Time
+	cur   int
+	prev  int
+}
+
+type rateEntry struct {
+	ip       string
+	lastSeen time.Time
+	counters []rateCounter
+}
+
+type rateChecker struct {
+	windows    []rateWindowConfig
+	field      string
+	match      *regexp.Regexp
+	ban        bool
+	score      harmScore
+	maxEntries int
+	// longest window, entries not seen for this time are removed
+	ttl time.Duration
+	now func() time.Time
+
+	// requests are counted by subnet when prefix is set
+	subnet  bool
+	prefix4 int
+	prefix6 int
+
+	mu   *sync.Mutex
+	data map[string]*list.Element
+	// most recently seen entries at front
+	lru *list.List
+
+	stop chan struct{}
+}
+
+func newRateChecker(cfg rateCheckerConfig) (*rateChecker, error) {
+	if len(cfg.Windows) == 0 {
+		return nil, fmt.Errorf("at least one window is required")
+	}
+
+	rc := &rateChecker{
+		windows:    cfg.Windows,
+		field:      cfg.FieldName,
+		score:      defaultRateScore,
+		maxEntries: defaultRateMaxEntries,
+		now:        time.Now,
+		mu:         &sync.Mutex{},
+		data:       map[string]*list.Element{},
+		lru:        list.New(),
+		stop:       make(chan struct{}),
+	}
+
+	var windows []string
+
+	for _, w := range cfg.Windows {
+		if w.Duration <= 0 || w.Limit <= 0 {
+			return nil, fmt.Errorf("window duration and limit must be positive (duration %s, limit %d)", w.Duration, w.Limit)
+		}
+
+		if w.Duration > rc.ttl {
+			rc.ttl = w.Duration
+		}
+
+		windows = append(windows, fmt.Sprintf(">%d in %s", w.Limit, w.Duration))
+	}
+
+	if cfg.Match != "" {
+		if cfg.FieldName == "" {
+			return nil, fmt.Errorf("field_name is required for match")
+		}
+
+		match, err := regexp.Compile(cfg.Match)
+		if err != nil {
+			return nil, fmt.Errorf("cannot compile match %q: %w", cfg.Match, err)
+		}
+
+		rc.match = match
+	}
+
+	switch strings.ToLower(cfg.Action) {
+	case "", rateActionBlock:
+		rc.ban = true
+	case rateActionScore:
+	default:
+		return nil, fmt.Errorf("unknow action %q (supported: %s, %s)", cfg.Action, rateActionBlock, rateActionScore)
+	}
+
+	if cfg.Score != 0 {
+		rc.score = harmScore(cfg.Score)
+	}
+
+	if cfg.MaxEntries != 0 {
+		rc.maxEntries = cfg.MaxEntries
+	}
+
+	log.Printf("rate limit %s, field %q match %q, action %s", strings.Join(windows, ", "), cfg.FieldName, cfg.Match, cfg.Action)
+
+	go rc.janitor()
+
+	return rc, nil
+}
+
+// newSubnetRateChecker create rate checker which count requests of all
+// IPs in subnet, exceeded subnet is set to cidr field
+func newSubnetRateChecker(cfg subnetRateCheckerConfig) (*rateChecker, error) {
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = defaultIPv4Prefix
+	}
+
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = defaultIPv6Prefix
+	}
+
+	if cfg.IPv4Prefix < 1 || cfg.IPv4Prefix > 32 {
+		return nil, fmt.Errorf("ipv4_prefix must be between 1 and 32, got %d", cfg.IPv4Prefix)
+	}
+
+	if cfg.IPv6Prefix < 1 || cfg.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("ipv6_prefix must be between 1 and 128, got %d", cfg.IPv6Prefix)
+	}
+
+	rc, err := newRateChecker(cfg.Rate)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.subnet = true
+	rc.prefix4 = cfg.IPv4Prefix
+	rc.prefix6 = cfg.IPv6Prefix
+
+	log.Printf("rate limit by subnet /%d (IPv4), /%d (IPv6)", cfg.IPv4Prefix, cfg.IPv6Prefix)
+
+	return rc, nil
+}
+
+func (rc *rateChecker) Check(l *logLine) (harm harmScore, descision instantDecision) {
+	// lines not matched by log format would share one counter
+	if l.IP() == nil {
+		return 0, decisionNone
+	}
+
+	if rc.match != nil {
+		val, ok := l.Get(rc.field)
+		if !ok || !rc.match.MatchString(val) {
+			return 0, decisionNone
+		}
+	}
+
+	key := rc.key(l.IP())
+
+	count, window, exceeded := rc.hit(key, rc.now())
+	if !exceeded {
+		return 0, decisionNone
+	}
+
+	l.Set(rateField, fmt.Sprintf("%d in %s", count, window))
+
+	if rc.subnet {
+		l.Set(cidrField, key)
+	}
+
+	if rc.ban {
+		return 0, decisionBan
+	}
+
+	return rc.score, decisionNone
+}
+
+// key return IP or its subnet in CIDR notation
+func (rc *rateChecker) key(ip net.IP) string {
+	if !rc.subnet {
+		return ip.String()
+	}
+
+	return subnetOf(ip, rc.prefix4, rc.prefix6).String()
+}
+
+// hit count request of IP or subnet and return first exceeded window
+func (rc *rateChecker) hit(key string, now time.Time) (int, time.Duration, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	var entry *rateEntry
+
+	if el, ok := rc.data[key]; ok {
+		entry = el.Value.(*rateEntry)
+		rc.lru.MoveToFront(el)
+	} else {
+		entry = &rateEntry{
+			ip:       key,
+			counters: make([]rateCounter, len(rc.windows)),
+		}
+		rc.data[key] = rc.lru.PushFront(entry)
+
+		// evict least recently seen
+		for len(rc.data) > rc.maxEntries {
+			rc.remove(rc.lru.Back())
+		}
+	}
+
+	entry.lastSeen = now
+
+	var count int
+	var window time.Duration
+	var exceeded bool
+
+	for i, w := range rc.windows {
+		n := entry.counters[i].add(now, w.Duration)
+
+		if n > w.Limit && !exceeded {
+			count, window, exceeded = n, w.Duration, true
+		}
+	}
+
+	return count, window, exceeded
+}
+
+// add count request and return estimated number of requests in window
+func (c *rateCounter) add(now time.Time, window time.Duration) int {
+	elapsed := now.Sub(c.start)
+
+	switch {
+	case elapsed >= 2*window:
+		c.prev = 0
+		c.cur = 0
+		c.start = now.Truncate(window)
+	case elapsed >= window:
+		c.prev = c.cur
+		c.cur = 0
+		c.start = c.start.Add(window)
+	}
+
+	c.cur++
+
+	overlap := window - now.Sub(c.start)
+
+	return c.cur + int(int64(c.prev)*int64(overlap)/int64(window))
+}
+
+func (rc *rateChecker) remove(el *list.Element) {
+	entry := rc.lru.Remove(el).(*rateEntry)
+	delete(rc.data, entry.ip)
+}
+
+// removeStale remove entries which can't exceed any window
+func (rc *rateChecker) removeStale(now time.Time) int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	removed := 0
+
+	for el := rc.lru.Back(); el != nil; el = rc.lru.Back() {
+		if now.Sub(el.Value.(*rateEntry).lastSeen) < 2*rc.ttl {
+			break
+		}
+
+		rc.remove(el)
+		removed++
+	}
+
+	return removed
+}
+
+func (rc *rateChecker) Len() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return len(rc.data)
+}
+
+func (rc *rateChecker) janitor() {
+	ticker := time.NewTicker(rateJanitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rc.stop:
+			return
+		case <-ticker.C:
+		}
+
+		removed := rc.removeStale(rc.now())
+		if removed > 0 {
+			log.Debugf("rate checker removed %d stale entries", removed)
+		}
+	}
+}
+
+func (rc *rateChecker) Close() error {
+	close(rc.stop)
+	return nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_rateChecker_Check(t *testing.T) {
+	type request struct {
+		after   time.Duration
+		ip      string
+		request string
+	}
+
+	// n requests from same IP with delay between them
+	repeat := func(n int, delay time.Duration, ip, req string) []request {
+		var r []request
+		for i := 0; i < n; i++ {
+			r = append(r, request{after: delay, ip: ip, request: req})
+		}
+		return r
+	}
+
+	tests := []struct {
+		name         string
+		cfg          rateCheckerConfig
+		requests     []request
+		wantHarm     harmScore
+		wantDecision instantDecision
+	}{
+		{
+			name: "under limit",
+			cfg: rateCheckerConfig{
+				Windows: []rateWindowConfig{{Duration: time.Second * 10, Limit: 30}},
+			},
+			requests:     repeat(30, time.Millisecond*100, "10.0.0.1", "GET / HTTP/1.1"),
+			wantDecision: decisionNone,
+		},
+		{
+			name: "over limit",
+			cfg: rateCheckerConfig{
+				Windows: []rateWindowConfig{{Duration: time.Second * 10, Limit: 30}},
+			},
+			requests:     repeat(31, time.Millisecond*100, "10.0.0.1", "GET / HTTP/1.1"),
+			wantDecision: decisionBan,
+		},
+		{
+			name: "slow requests are not counted after window",
+			cfg: rateCheckerConfig{
+				Windows: []rateWindowConfig{{Duration: time.Second * 10, Limit: 5}},
+			},
+			requests:     repeat(20, time.Second*5, "10.0.0.1", "GET / HTTP/1.1"),
+			wantDecision: decisionNone,
+		},
+		{
+			name: "long window",
+			cfg: rateCheckerConfig{
+				Windows: []rateWindowConfig{
+					{Duration: time.Second * 10, Limit: 30},
+					{Duration: time.Minute * 10, Limit: 100},
+				},
+			},
+			requests:     repeat(101, time.Second, "10.0.0.1", "GET / HTTP/1.1"),
+			wantDecision: decisionBan,
+		},
+		{
+			name: "other IPs are counted separately",
+			cfg: rateCheckerConfig{
+				Windows: []rateWindowConfig{{Duration: time.Second * 10, Limit: 3}},
+			},
+			requests: append(
+				repeat(3, time.Millisecond, "10.0.0.1", "GET / HTTP/1.1"),
+				repeat(3, time.Millisecond, "10.0.0.2", "GET / HTTP/1.1")...,
+			),
+			wantDecision: decisionNone,
+		},
+		{
+			name: "not matched requests are not counted",
+			cfg: rateCheckerConfig{
+				Windows:   []rateWindowConfig{{Duration: time.Second * 10, Limit: 3}},
+				FieldName: "request",
+				Match:     `^GET /search`,
+			},
+			requests: append(
+				repeat(3, time.Millisecond, "10.0.0.1", "GET /search?q=1 HTTP/1.1"),
+				repeat(3, time.Millisecond, "10.0.0.1", "GET / HTTP/1.1")...,
+			),
+			wantDecision: decisionNone,
+		},
+		{
+			name: "matched requests over limit",
+			cfg: rateCheckerConfig{
+				Windows:   []rateWindowConfig{{Duration: time.Second * 10, Limit: 3}},
+				FieldName: "request",
+				Match:     `^GET /search`,
+			},
+			requests:     repeat(4, time.Millisecond, "10.0.0.1", "GET /search?q=1 HTTP/1.1"),
+			wantDecision: decisionBan,
+		},
+		{
+			name: "score",
+			cfg: rateCheckerConfig{
+				Windows: []rateWindowConfig{{Duration: time.Second * 10, Limit: 3}},
+				Action:  "score",
+				Score:   5,
+			},
+			requests:     repeat(4, time.Millisecond, "10.0.0.1", "GET / HTTP/1.1"),
+			wantHarm:     5,
+			wantDecision: decisionNone,
+		},
+		{
+			name: "lines without IP are not counted",
+			cfg: rateCheckerConfig{
+				Windows: []rateWindowConfig{{Duration: time.Second * 10, Limit: 3}},
+			},
+			requests:     repeat(4, time.Millisecond, "", "GET / HTTP/1.1"),
+			wantDecision: decisionNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := newRateChecker(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+
+			now := time.Date(2021, 6, 24, 12, 0, 0, 0, time.UTC)
+			rc.now = func() time.Time { return now }
+
+			var harm harmScore
+			var decision instantDecision
+
+			for _, r := range tt.requests {
+				now = now.Add(r.after)
+
+				harm, decision = rc.Check(&logLine{
+					ip:     net.ParseIP(r.ip),
+					fields: map[string]string{"request": r.request},
+				})
+			}
+
+			if harm != tt.wantHarm {
+				t.Errorf("rateChecker.Check() harm = %v, want %v", harm, tt.wantHarm)
+			}
+
+			if decision != tt.wantDecision {
+				t.Errorf("rateChecker.Check() decision = %v, want %v", decision, tt.wantDecision)
+			}
+		})
+	}
+}
+
+func Test_rateChecker_memory(t *testing.T) {
+	rc, err := newRateChecker(rateCheckerConfig{
+		Windows:    []rateWindowConfig{{Duration: time.Second * 10, Limit: 3}},
+		MaxEntries: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	now := time.Now()
+
+	rc.hit("10.0.0.1", now)
+	rc.hit("10.0.0.2", now)
+	rc.hit("10.0.0.3", now.Add(time.Second*15))
+
+	if rc.Len() != 2 {
+		t.Fatalf("got %d entries, want 2", rc.Len())
+	}
+
+	if removed := rc.removeStale(now.Add(time.Second * 25)); removed != 1 {
+		t.Errorf("removeStale() = %d, want 1", removed)
+	}
+}
+
+func Test_subnetRateChecker_Check(t *testing.T) {
+	tests := []struct {
+		name         string
+		ips          []string
+		wantDecision instantDecision
+		wantCIDR     string
+	}{
+		{
+			name:         "IPv4 subnet",
+			ips:          []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			wantDecision: decisionBan,
+			wantCIDR:     "10.0.0.0/24",
+		},
+		{
+			name:         "different IPv4 subnets",
+			ips:          []string{"10.0.0.1", "10.0.1.2", "10.0.2.3", "10.0.3.4"},
+			wantDecision: decisionNone,
+		},
+		{
+			name:         "IPv6 subnet",
+			ips:          []string{"2001:db8::1", "2001:db8::2", "2001:db8::ffff:3", "2001:db8::4:0:0:4"},
+			wantDecision: decisionBan,
+			wantCIDR:     "2001:db8::/64",
+		},
+		{
+			name:         "lines without IP",
+			ips:          []string{"", "", "", ""},
+			wantDecision: decisionNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := newSubnetRateChecker(subnetRateCheckerConfig{
+				Rate: rateCheckerConfig{
+					Windows: []rateWindowConfig{{Duration: time.Second * 10, Limit: 3}},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+
+			var decision instantDecision
+			var l *logLine
+
+			for _, ip := range tt.ips {
+				l = &logLine{ip: net.ParseIP(ip), fields: map[string]string{}}
+				_, decision = rc.Check(l)
+			}
+
+			if decision != tt.wantDecision {
+				t.Errorf("rateChecker.Check() decision = %v, want %v", decision, tt.wantDecision)
+			}
+
+			if cidr, _ := l.Get(cidrField); cidr != tt.wantCIDR {
+				t.Errorf("got cidr %q, want %q", cidr, tt.wantCIDR)
+			}
+		})
+	}
+}
@@ -14,26 +14,41 @@ import (
 const (
 	resolverLookupTimeout = time.Second * 5
 	dnsDialerTimeout      = time.Second * 5
+
+	// results of IP verification, used as source in cache
+	rdnsVerified = "verified"
+	rdnsFailed   = "failed"
+	rdnsError    = "error"
+
+	defaultRDNSVerifiedTTL = time.Hour * 24
+	defaultRDNSFailedTTL   = time.Hour
+	defaultRDNSErrorTTL    = time.Minute
+	defaultRDNSCacheSize   = 100000
 )
 
+type reverseDNSCacheConfig struct {
+	Path        string        `yaml:"path"`
+	VerifiedTTL time.Duration `yaml:"verified_ttl"`
+	FailedTTL   time.Duration `yaml:"failed_ttl"`
+	ErrorTTL    time.Duration `yaml:"error_ttl"`
+	MaxSize     int           `yaml:"max_size"`
+}
+
 type resolverListConfig struct {
 	addrs []string
 }
 
-type reverseDNSCheckerConfig struct {
-	Rules []struct {
-		Field          string             `yaml:"field"`
-		FieldContains  []string           `yaml:"field_contains"`
-		DomainSuffixes []string           `yaml:"domain_suffixes"`
-		Resolvers      resolverListConfig `yaml:"resolver"`
-	} `yaml:"rules"`
+type reverseDNSRuleConfig struct {
+	Field          string             `yaml:"field"`
+	FieldContains  []string           `yaml:"field_contains"`
+	DomainSuffixes []string           `yaml:"domain_suffixes"`
+	Resolvers      resolverListConfig `yaml:"resolver"`
 }
 
-type resolverPool struct {
-	// next index in pool
-	next int
-
-	resolvers []*net.Resolver
+type reverseDNSCheckerConfig struct {
+	Rules []reverseDNSRuleConfig `yaml:"rules"`
+	Cache reverseDNSCacheConfig  `yaml:"cache"`
+	Async reverseDNSAsyncConfig  `yaml:"async"`
 }
 
 type reverseDNSCheckerRule struct {
@@ -45,6 +60,13 @@ type reverseDNSCheckerRule struct {
 
 type reverseDNSChecker struct {
 	rules []reverseDNSCheckerRule
+
+	// verification results by IP and rule
+	cache *ipCache
+	stop  chan struct{}
+
+	// nil if IPs are verified synchronously
+	async *rdnsWorkerPool
 }
 
 func newReverseDNSChecker(cfg reverseDNSCheckerConfig) (*reverseDNSChecker, error) {
@@ -63,7 +85,10 @@ func newReverseDNSChecker(cfg reverseDNSCheckerConfig) (*reverseDNSChecker, erro
 			return nil, fmt.Errorf("domain_suffixes cannot be empty")
 		}
 
-		resolverPool := makeResolverPoolFromConfig(r.Resolvers)
+		resolverPool, err := makeResolverPoolFromConfig(r.Resolvers)
+		if err != nil {
+			return nil, err
+		}
 
 		log.Printf("reverse dns field %q must contains [%s] DNS suffix [%s] resolver %s", r.Field, strings.Join(r.FieldContains, ","), strings.Join(r.DomainSuffixes, ","), r.Resolvers)
 
@@ -75,64 +100,165 @@ func newReverseDNSChecker(cfg reverseDNSCheckerConfig) (*reverseDNSChecker, erro
 		})
 	}
 
-	return &reverseDNSChecker{rules: rules}, nil
+	cache, err := newReverseDNSCache(cfg.Cache)
+	if err != nil {
+		return nil, err
+	}
+
+	rdns := &reverseDNSChecker{
+		rules: rules,
+		cache: cache,
+		stop:  make(chan struct{}),
+	}
+
+	if cfg.Async.Workers > 0 {
+		rdns.async, err = newRDNSWorkerPool(rdns, cfg.Async)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	go cache.saver(rdns.stop)
+
+	return rdns, nil
 }
 
-func makeResolverPoolFromConfig(resolversCfg resolverListConfig) *resolverPool {
-	if resolversCfg.len() == 0 {
-		return newDefaultResolverPool()
+func newReverseDNSCache(cfg reverseDNSCacheConfig) (*ipCache, error) {
+	cacheCfg := ipCacheConfig{
+		path: cfg.Path,
+		sourceTTL: map[string]time.Duration{
+			rdnsVerified: defaultRDNSVerifiedTTL,
+			rdnsFailed:   defaultRDNSFailedTTL,
+			rdnsError:    defaultRDNSErrorTTL,
+		},
+		maxSize: defaultRDNSCacheSize,
 	}
 
-	var resolvers []*net.Resolver
+	if cfg.VerifiedTTL != 0 {
+		cacheCfg.sourceTTL[rdnsVerified] = cfg.VerifiedTTL
+	}
 
-	for _, addr := range resolversCfg.addrs {
-		// default dns port
-		if !strings.Contains(addr, ":") {
-			addr += ":53"
-		}
+	if cfg.FailedTTL != 0 {
+		cacheCfg.sourceTTL[rdnsFailed] = cfg.FailedTTL
+	}
 
-		resolvers = append(resolvers, &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				d := net.Dialer{
-					Timeout: dnsDialerTimeout,
-				}
+	if cfg.ErrorTTL != 0 {
+		cacheCfg.sourceTTL[rdnsError] = cfg.ErrorTTL
+	}
 
-				switch network {
-				case "udp", "udp4", "udp6":
-					return d.DialContext(ctx, "udp4", addr)
-				case "tcp", "tcp4", "tcp6":
-					return d.DialContext(ctx, "tcp4", addr)
-				default:
-					panic("PatchNet.Dial: unknown network")
-				}
-			},
-		})
+	if cfg.MaxSize != 0 {
+		cacheCfg.maxSize = cfg.MaxSize
 	}
 
-	return newResolverPool(resolvers)
+	cache, err := newIPCaheFromFile(cacheCfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load reverse DNS cache: %w", err)
+	}
+
+	log.Printf("reverse dns cache ttl verified %s, failed %s, error %s", cacheCfg.sourceTTL[rdnsVerified], cacheCfg.sourceTTL[rdnsFailed], cacheCfg.sourceTTL[rdnsError])
+
+	return cache, nil
 }
 
 func (rdns *reverseDNSChecker) Check(l *logLine) (score harmScore, descision instantDecision) {
-	for _, rule := range rdns.rules {
-		if rule.match(*l) {
-			ok, err := rule.fineDNS(l.IP())
-			if err != nil {
-				log.Printf("cannot check DNS for %q: %v", l.IP(), err)
-				return 0, decisionNone
-			}
+	for i := range rdns.rules {
+		rule := &rdns.rules[i]
 
-			if ok {
-				return 0, decisionWhitelist
-			}
-
-			return 0, decisionBan
+		if rule.match(*l) {
+			return rdns.checkRule(rule, l)
 		}
 	}
 
 	return 0, decisionNone
 }
 
+// checkRule verify IP of line by rule
+func (rdns *reverseDNSChecker) checkRule(rule *reverseDNSCheckerRule, l *logLine) (score harmScore, descision instantDecision) {
+	key := rdnsCacheKey(rule, l.IP())
+
+	result, ok := rdns.cached(key)
+	if !ok && rdns.async != nil {
+		return rdns.async.enqueue(rule, key, l)
+	}
+
+	if !ok {
+		result = rdns.resolve(rule, l.IP(), key)
+	}
+
+	switch result {
+	case rdnsVerified:
+		return 0, decisionWhitelist
+	case rdnsFailed:
+		return 0, decisionBan
+	default:
+		return 0, decisionNone
+	}
+}
+
+// rdnsCacheKey same IP can be verified by rules with different suffixes
+func rdnsCacheKey(rule *reverseDNSCheckerRule, ip net.IP) string {
+	return ip.String() + "@" + strings.Join(rule.domainSufixes, ",")
+}
+
+func (rdns *reverseDNSChecker) cached(key string) (string, bool) {
+	result, ok := rdns.cache.lookupKey(key)
+	if ok {
+		rdnsCacheCounter.WithLabelValues("hit").Inc()
+	} else {
+		rdnsCacheCounter.WithLabelValues("miss").Inc()
+	}
+
+	return result, ok
+}
+
+// resolve verify IP by rule and cache result
+func (rdns *reverseDNSChecker) resolve(rule *reverseDNSCheckerRule, ip net.IP, key string) string {
+	startedAt := time.Now()
+	ok, err := rule.fineDNS(ip)
+	rdnsLookupSummary.Observe(time.Since(startedAt).Seconds())
+
+	result := rdnsFailed
+
+	switch {
+	case err != nil:
+		log.Printf("cannot check DNS for %q: %v", ip, err)
+		result = rdnsError
+	case ok:
+		result = rdnsVerified
+	}
+
+	rdns.cache.addKey(key, result)
+
+	return result
+}
+
+func (rdns *reverseDNSChecker) setRecheck(recheck chan<- *logLine) {
+	if rdns.async != nil {
+		rdns.async.setRecheck(recheck)
+	}
+}
+
+// SaveState save cache, so checker created on reload load latest results
+func (rdns *reverseDNSChecker) SaveState() error {
+	_, err := rdns.cache.Save()
+	if err != nil {
+		return fmt.Errorf("cannot save reverse DNS cache: %w", err)
+	}
+
+	return nil
+}
+
+// Close stop workers and saving of cache and save it last time
+func (rdns *reverseDNSChecker) Close() error {
+	if rdns.async != nil {
+		rdns.async.Close()
+	}
+
+	close(rdns.stop)
+
+	return rdns.SaveState()
+}
+
 func (r *reverseDNSCheckerRule) match(l logLine) bool {
 	field, ok := l.Get(r.field)
 	if !ok {
@@ -166,11 +292,13 @@ func (r *reverseDNSCheckerRule) fineDNS(ip net.IP) (bool, error) {
 	resolver := r.resolverPool.get()
 
 	addrs, err := resolver.LookupAddr(ctx, ip.String())
+	r.resolverPool.report(resolver, err)
 
 	if err != nil {
-		// any misconfigured DNS lead to ban
+		// any misconfigured DNS lead to ban, timeouts and server failures
+		// are errors and checked again later
 		dnsErr := &net.DNSError{}
-		if errors.As(err, &dnsErr) {
+		if errors.As(err, &dnsErr) && !dnsErr.IsTimeout && !dnsErr.IsTemporary {
 			log.Printf("reverse lookup error: %v", dnsErr)
 			return false, nil
 		}
@@ -189,7 +317,7 @@ func (r *reverseDNSCheckerRule) fineDNS(ip net.IP) (bool, error) {
 			lookupIPs, lookupErr := resolver.LookupIPAddr(lookupCtx, name)
 			if lookupErr != nil {
 				dnsErr := &net.DNSError{}
-				if errors.As(err, &dnsErr) {
+				if errors.As(lookupErr, &dnsErr) && !dnsErr.IsTimeout && !dnsErr.IsTemporary {
 					log.Printf("lookup error: %v", dnsErr)
 					return false, nil
 				}
@@ -207,6 +335,7 @@ func (r *reverseDNSCheckerRule) fineDNS(ip net.IP) (bool, error) {
 
 	return false, nil
 }
+
 func (list *resolverListConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var str string
 
@@ -236,32 +365,3 @@ func (list *resolverListConfig) UnmarshalYAML(unmarshal func(interface{}) error)
 func (list *resolverListConfig) len() int {
 	return len(list.addrs)
 }
-
-func newResolverPool(resolvers []*net.Resolver) *resolverPool {
-	if len(resolvers) == 0 {
-		log.Fatalf("resolvers list must contain at last one resolver")
-	}
-
-	return &resolverPool{
-		resolvers: resolvers,
-	}
-}
-
-func newDefaultResolverPool() *resolverPool {
-	return &resolverPool{
-		resolvers: []*net.Resolver{
-			&net.Resolver{},
-		},
-	}
-}
-
-func (pool *resolverPool) get() *net.Resolver {
-	r := pool.resolvers[pool.next]
-
-	pool.next++
-	if pool.next > len(pool.resolvers) {
-		pool.next = 0
-	}
-
-	return r
-}
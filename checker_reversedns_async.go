@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	rdnsProvisionalPass  = "pass"
+	rdnsProvisionalHold  = "hold"
+	rdnsProvisionalScore = "score"
+
+	defaultRDNSQueueSize = 1000
+)
+
+type reverseDNSAsyncConfig struct {
+	// zero workers means IPs are verified synchronously
+	Workers   int `yaml:"workers"`
+	QueueSize int `yaml:"queue_size"`
+	// decision for lines of IP while it is verified: pass, hold or score
+	Provisional      string `yaml:"provisional"`
+	ProvisionalScore int    `yaml:"provisional_score"`
+}
+
+type rdnsJob struct {
+	rule *reverseDNSCheckerRule
+	key  string
+	ip   net.IP
+	// line is sent to recheck when verification is done
+	l *logLine
+}
+
+// rdnsWorkerPool verify IPs in background, line is decided again when
+// result is in cache
+type rdnsWorkerPool struct {
+	rdns *reverseDNSChecker
+	jobs chan rdnsJob
+
+	provisionalScore    harmScore
+	provisionalDecision instantDecision
+
+	mu      *sync.Mutex
+	pending map[string]bool
+	recheck chan<- *logLine
+
+	stop chan struct{}
+	wg   *sync.WaitGroup
+}
+
+func newRDNSWorkerPool(rdns *reverseDNSChecker, cfg reverseDNSAsyncConfig) (*rdnsWorkerPool, error) {
+	pool := &rdnsWorkerPool{
+		rdns:    rdns,
+		mu:      &sync.Mutex{},
+		pending: map[string]bool{},
+		stop:    make(chan struct{}),
+		wg:      &sync.WaitGroup{},
+	}
+
+	switch strings.ToLower(cfg.Provisional) {
+	case "", rdnsProvisionalPass:
+		pool.provisionalDecision = decisionNone
+	case rdnsProvisionalHold:
+		pool.provisionalDecision = decisionHold
+	case rdnsProvisionalScore:
+		pool.provisionalDecision = decisionNone
+		pool.provisionalScore = harmScore(cfg.ProvisionalScore)
+	default:
+		return nil, fmt.Errorf("unknow provisional decision %q (supported: %s, %s, %s)", cfg.Provisional, rdnsProvisionalPass, rdnsProvisionalHold, rdnsProvisionalScore)
+	}
+
+	queueSize := defaultRDNSQueueSize
+	if cfg.QueueSize != 0 {
+		queueSize = cfg.QueueSize
+	}
+
+	pool.jobs = make(chan rdnsJob, queueSize)
+
+	for i := 0; i < cfg.Workers; i++ {
+		pool.wg.Add(1)
+		go pool.worker()
+	}
+
+	log.Printf("reverse dns async workers %d, queue size %d, provisional %s", cfg.Workers, queueSize, cfg.Provisional)
+
+	return pool, nil
+}
+
+// enqueue start verification of IP if it is not verified already and
+// return provisional decision, line not queued for recheck is never held
+// because it would be lost
+func (pool *rdnsWorkerPool) enqueue(rule *reverseDNSCheckerRule, key string, l *logLine) (harmScore, instantDecision) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.pending[key] {
+		// line of same IP is already queued and decided again
+		return pool.provisionalScore, decisionNone
+	}
+
+	c := l.Clone()
+	c.recheckHeld = pool.provisionalDecision == decisionHold
+
+	select {
+	case pool.jobs <- rdnsJob{rule: rule, key: key, ip: l.IP(), l: c}:
+		pool.pending[key] = true
+		rdnsQueueGauge.Set(float64(len(pool.jobs)))
+	default:
+		// queue is full, IP is verified with one of next lines
+		rdnsDroppedCounter.Inc()
+		log.Debugf("reverse dns queue is full, %s is not verified", l.IP())
+
+		return pool.provisionalScore, decisionNone
+	}
+
+	return pool.provisionalScore, pool.provisionalDecision
+}
+
+func (pool *rdnsWorkerPool) worker() {
+	defer pool.wg.Done()
+
+	for {
+		var job rdnsJob
+
+		select {
+		case <-pool.stop:
+			return
+		case job = <-pool.jobs:
+		}
+
+		rdnsQueueGauge.Set(float64(len(pool.jobs)))
+
+		pool.rdns.resolve(job.rule, job.ip, job.key)
+
+		pool.mu.Lock()
+		delete(pool.pending, job.key)
+		recheck := pool.recheck
+		pool.mu.Unlock()
+
+		if recheck == nil {
+			continue
+		}
+
+		select {
+		case recheck <- job.l:
+		case <-pool.stop:
+			rechecksAbandonedCounter.Inc()
+			return
+		}
+	}
+}
+
+func (pool *rdnsWorkerPool) setRecheck(recheck chan<- *logLine) {
+	pool.mu.Lock()
+	pool.recheck = recheck
+	pool.mu.Unlock()
+}
+
+// Close stop workers, queued IPs are not verified
+func (pool *rdnsWorkerPool) Close() {
+	close(pool.stop)
+	pool.wg.Wait()
+
+	if n := len(pool.jobs); n > 0 {
+		rechecksAbandonedCounter.Add(float64(n))
+		log.Printf("reverse dns verification of %d queued IPs is abandoned", n)
+	}
+}
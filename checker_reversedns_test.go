@@ -1,13 +1,19 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"log"
 
 	"github.com/foxcpp/go-mockdns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/yaml.v2"
 )
 
 var dnsTestZone = map[string]mockdns.Zone{
@@ -51,12 +57,7 @@ func Test_reverseDNSChecker_Check(t *testing.T) {
 		{
 			name: "simple whitelist",
 			cfg: reverseDNSCheckerConfig{
-				Rules: []struct {
-					Field          string             `yaml:"field"`
-					FieldContains  []string           `yaml:"field_contains"`
-					DomainSuffixes []string           `yaml:"domain_suffixes"`
-					Resolvers      resolverListConfig `yaml:"resolver"`
-				}{
+				Rules: []reverseDNSRuleConfig{
 					{
 						Field:          "user_agent",
 						FieldContains:  []string{"clientbot"},
@@ -81,12 +82,7 @@ func Test_reverseDNSChecker_Check(t *testing.T) {
 		{
 			name: "googlebot whitelist",
 			cfg: reverseDNSCheckerConfig{
-				Rules: []struct {
-					Field          string             `yaml:"field"`
-					FieldContains  []string           `yaml:"field_contains"`
-					DomainSuffixes []string           `yaml:"domain_suffixes"`
-					Resolvers      resolverListConfig `yaml:"resolver"`
-				}{
+				Rules: []reverseDNSRuleConfig{
 					{
 						Field:          "user_agent",
 						FieldContains:  []string{"Googlebot"},
@@ -111,12 +107,7 @@ func Test_reverseDNSChecker_Check(t *testing.T) {
 		{
 			name: "not exist PTR blacklist",
 			cfg: reverseDNSCheckerConfig{
-				Rules: []struct {
-					Field          string             `yaml:"field"`
-					FieldContains  []string           `yaml:"field_contains"`
-					DomainSuffixes []string           `yaml:"domain_suffixes"`
-					Resolvers      resolverListConfig `yaml:"resolver"`
-				}{
+				Rules: []reverseDNSRuleConfig{
 					{
 						Field:          "user_agent",
 						FieldContains:  []string{"clientbot"},
@@ -141,12 +132,7 @@ func Test_reverseDNSChecker_Check(t *testing.T) {
 		{
 			name: "bad PTR blacklist",
 			cfg: reverseDNSCheckerConfig{
-				Rules: []struct {
-					Field          string             `yaml:"field"`
-					FieldContains  []string           `yaml:"field_contains"`
-					DomainSuffixes []string           `yaml:"domain_suffixes"`
-					Resolvers      resolverListConfig `yaml:"resolver"`
-				}{
+				Rules: []reverseDNSRuleConfig{
 					{
 						Field:          "user_agent",
 						FieldContains:  []string{"clientbot"},
@@ -171,12 +157,7 @@ func Test_reverseDNSChecker_Check(t *testing.T) {
 		{
 			name: "fake PTR blacklist",
 			cfg: reverseDNSCheckerConfig{
-				Rules: []struct {
-					Field          string             `yaml:"field"`
-					FieldContains  []string           `yaml:"field_contains"`
-					DomainSuffixes []string           `yaml:"domain_suffixes"`
-					Resolvers      resolverListConfig `yaml:"resolver"`
-				}{
+				Rules: []reverseDNSRuleConfig{
 					{
 						Field:          "user_agent",
 						FieldContains:  []string{"googlebot"},
@@ -235,3 +216,296 @@ func dnsMockCreator(t *testing.T) (createDNS func(map[string]mockdns.Zone) strin
 			}
 		}
 }
+
+func Test_reverseDNSChecker_cache(t *testing.T) {
+	createDNSServer, closeDNS := dnsMockCreator(t)
+	defer closeDNS()
+
+	cachePath := filepath.Join(t.TempDir(), "rdns.cache")
+
+	newChecker := func(resolver string) *reverseDNSChecker {
+		var cfg reverseDNSCheckerConfig
+
+		err := yaml.Unmarshal([]byte(fmt.Sprintf(`
+rules:
+  - field: user_agent
+    field_contains: [clientbot]
+    domain_suffixes: [unittesting.org]
+    resolver: %s
+cache:
+  path: %s
+`, resolver, cachePath)), &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rdns, err := newReverseDNSChecker(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return rdns
+	}
+
+	check := func(rdns *reverseDNSChecker, ip net.IP) instantDecision {
+		_, decision := rdns.Check(&logLine{
+			ip:     ip,
+			fields: map[string]string{"user_agent": "clientbot"},
+		})
+
+		return decision
+	}
+
+	verified := net.IPv4(1, 2, 3, 4)
+	failed := net.IPv4(2, 3, 4, 5)
+
+	rdns := newChecker(createDNSServer(dnsTestZone))
+
+	if got := check(rdns, verified); got != decisionWhitelist {
+		t.Fatalf("Check() = %v, want %v", got, decisionWhitelist)
+	}
+
+	if got := check(rdns, failed); got != decisionBan {
+		t.Fatalf("Check() = %v, want %v", got, decisionBan)
+	}
+
+	err := rdns.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// results are restored from cache without DNS queries
+	restored := newChecker(createDNSServer(map[string]mockdns.Zone{}))
+	defer restored.Close()
+
+	if got := check(restored, verified); got != decisionWhitelist {
+		t.Errorf("Check() from cache = %v, want %v", got, decisionWhitelist)
+	}
+
+	if got := check(restored, failed); got != decisionBan {
+		t.Errorf("Check() from cache = %v, want %v", got, decisionBan)
+	}
+
+	if restored.cache.Len() != 2 {
+		t.Errorf("got %d cached results, want 2", restored.cache.Len())
+	}
+}
+
+func Test_reverseDNSChecker_async(t *testing.T) {
+	createDNSServer, closeDNS := dnsMockCreator(t)
+	defer closeDNS()
+
+	tests := []struct {
+		name                string
+		provisional         string
+		ip                  net.IP
+		wantProvisional     instantDecision
+		wantProvisionalHarm harmScore
+		wantDecision        instantDecision
+	}{
+		{
+			name:            "hold verified",
+			provisional:     "hold",
+			ip:              net.IPv4(1, 2, 3, 4),
+			wantProvisional: decisionHold,
+			wantDecision:    decisionWhitelist,
+		},
+		{
+			name:            "pass failed",
+			provisional:     "pass",
+			ip:              net.IPv4(2, 3, 4, 5),
+			wantProvisional: decisionNone,
+			wantDecision:    decisionBan,
+		},
+		{
+			name:                "score failed",
+			provisional:         "score",
+			ip:                  net.IPv4(2, 3, 4, 5),
+			wantProvisional:     decisionNone,
+			wantProvisionalHarm: 2,
+			wantDecision:        decisionBan,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg reverseDNSCheckerConfig
+
+			err := yaml.Unmarshal([]byte(fmt.Sprintf(`
+rules:
+  - field: user_agent
+    field_contains: [clientbot]
+    domain_suffixes: [unittesting.org]
+    resolver: %s
+async:
+  workers: 2
+  provisional: %s
+  provisional_score: 2
+`, createDNSServer(dnsTestZone), tt.provisional)), &cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rdns, err := newReverseDNSChecker(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rdns.Close()
+
+			recheck := make(chan *logLine)
+			rdns.setRecheck(recheck)
+
+			harm, decision := rdns.Check(&logLine{
+				ip:     tt.ip,
+				fields: map[string]string{"user_agent": "clientbot"},
+			})
+			if harm != tt.wantProvisionalHarm || decision != tt.wantProvisional {
+				t.Fatalf("provisional Check() = %v, %v, want %v, %v", harm, decision, tt.wantProvisionalHarm, tt.wantProvisional)
+			}
+
+			var l *logLine
+
+			select {
+			case l = <-recheck:
+			case <-time.After(time.Second * 5):
+				t.Fatal("line is not rechecked")
+			}
+
+			if !l.IP().Equal(tt.ip) {
+				t.Fatalf("rechecked line of %s, want %s", l.IP(), tt.ip)
+			}
+
+			if _, decision := rdns.Check(l); decision != tt.wantDecision {
+				t.Errorf("Check() after verification = %v, want %v", decision, tt.wantDecision)
+			}
+		})
+	}
+}
+
+func Test_rdnsWorkerPool_overflow(t *testing.T) {
+	rdns, err := newReverseDNSChecker(reverseDNSCheckerConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdns.Close()
+
+	// no workers, so queue is not drained
+	pool, err := newRDNSWorkerPool(rdns, reverseDNSAsyncConfig{QueueSize: 2, Provisional: rdnsProvisionalHold})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rule := &reverseDNSCheckerRule{domainSufixes: []string{"unittesting.org"}}
+
+	dropped := testutil.ToFloat64(rdnsDroppedCounter)
+
+	tests := []struct {
+		ip           net.IP
+		wantDecision instantDecision
+	}{
+		{ip: net.IPv4(1, 2, 3, 0), wantDecision: decisionHold},
+		{ip: net.IPv4(1, 2, 3, 1), wantDecision: decisionHold},
+		// IP is pending, line is not queued for recheck, so it is not held
+		{ip: net.IPv4(1, 2, 3, 1), wantDecision: decisionNone},
+		// queue is full, not queued lines are passed to next checkers
+		{ip: net.IPv4(1, 2, 3, 2), wantDecision: decisionNone},
+		{ip: net.IPv4(1, 2, 3, 3), wantDecision: decisionNone},
+		{ip: net.IPv4(1, 2, 3, 4), wantDecision: decisionNone},
+	}
+
+	for _, tt := range tests {
+		_, decision := pool.enqueue(rule, rdnsCacheKey(rule, tt.ip), &logLine{ip: tt.ip, fields: map[string]string{}})
+		if decision != tt.wantDecision {
+			t.Errorf("enqueue(%s) = %v, want %v", tt.ip, decision, tt.wantDecision)
+		}
+	}
+
+	if got := testutil.ToFloat64(rdnsDroppedCounter) - dropped; got != 3 {
+		t.Errorf("got %v dropped IPs, want 3", got)
+	}
+
+	// queued IPs are abandoned on close
+	abandoned := testutil.ToFloat64(rechecksAbandonedCounter)
+
+	pool.Close()
+
+	if got := testutil.ToFloat64(rechecksAbandonedCounter) - abandoned; got != 2 {
+		t.Errorf("got %v abandoned IPs, want 2", got)
+	}
+}
+
+func Test_reverseDNSChecker_lookupErrors(t *testing.T) {
+	createDNSServer, closeDNS := dnsMockCreator(t)
+	defer closeDNS()
+
+	zone := map[string]mockdns.Zone{
+		// PTR to name without A record
+		"7.7.7.7.in-addr.arpa.": {
+			PTR: []string{"ghost.unittesting.org."},
+		},
+		// server failure on forward lookup
+		"8.8.8.8.in-addr.arpa.": {
+			PTR: []string{"broken.unittesting.org."},
+		},
+		"broken.unittesting.org.": {
+			Err: errors.New("server failure"),
+		},
+		// server failure on reverse lookup
+		"9.9.9.9.in-addr.arpa.": {
+			Err: errors.New("server failure"),
+		},
+	}
+
+	tests := []struct {
+		name         string
+		ip           net.IP
+		wantDecision instantDecision
+		wantResult   string
+	}{
+		{
+			name:         "forward lookup not found",
+			ip:           net.IPv4(7, 7, 7, 7),
+			wantDecision: decisionBan,
+			wantResult:   rdnsFailed,
+		},
+		{
+			name:         "forward lookup server failure",
+			ip:           net.IPv4(8, 8, 8, 8),
+			wantDecision: decisionNone,
+			wantResult:   rdnsError,
+		},
+		{
+			name:         "reverse lookup server failure",
+			ip:           net.IPv4(9, 9, 9, 9),
+			wantDecision: decisionNone,
+			wantResult:   rdnsError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rdns, err := newReverseDNSChecker(reverseDNSCheckerConfig{
+				Rules: []reverseDNSRuleConfig{
+					{
+						Field:          "user_agent",
+						FieldContains:  []string{"clientbot"},
+						DomainSuffixes: []string{"unittesting.org"},
+						Resolvers:      resolverListConfig{addrs: []string{createDNSServer(zone)}},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rdns.Close()
+
+			_, decision := rdns.Check(&logLine{ip: tt.ip, fields: map[string]string{"user_agent": "clientbot"}})
+			if decision != tt.wantDecision {
+				t.Errorf("Check() = %v, want %v", decision, tt.wantDecision)
+			}
+
+			result, ok := rdns.cache.lookupKey(rdnsCacheKey(&rdns.rules[0], tt.ip))
+			if !ok || result != tt.wantResult {
+				t.Errorf("cached result = %q, want %q", result, tt.wantResult)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	// name of verified bot preset matched by user agent
+	botField = "bot"
+
+	defaultVerifiedBotsField = "user_agent"
+
+	defaultBotIPRangesRefreshInterval = time.Hour * 24
+)
+
+var _ checker = &verifiedBotsChecker{}
+
+// botPreset known search engine bot, bot is verified by published IP ranges
+// or by reverse DNS if ranges are missing or IP is not in ranges
+type botPreset struct {
+	name string
+	// substrings of user agent
+	userAgents []string
+	// allowed suffixes of PTR record, empty if bot can be verified only by IP ranges
+	domainSuffixes []string
+	// url of published IP ranges in Google JSON format, empty if not published
+	ipRangesURL string
+}
+
+// botPresets maintained definitions of search engines bots
+var botPresets = []botPreset{
+	{
+		name:           "googlebot",
+		userAgents:     []string{"Googlebot", "AdsBot-Google", "Mediapartners-Google", "APIs-Google", "Google-InspectionTool", "GoogleOther", "Storebot-Google"},
+		domainSuffixes: []string{".googlebot.com", ".google.com"},
+		ipRangesURL:    "https://developers.google.com/static/search/apis/ipranges/googlebot.json",
+	},
+	{
+		name:           "bingbot",
+		userAgents:     []string{"bingbot", "BingPreview", "msnbot", "adidxbot"},
+		domainSuffixes: []string{".search.msn.com"},
+		ipRangesURL:    "https://www.bing.com/toolbox/bingbot.json",
+	},
+	{
+		name:           "yandex",
+		userAgents:     []string{"YandexBot", "YandexImages", "YandexMobileBot", "YandexAccessibilityBot", "YandexRenderResourcesBot", "YandexMetrika", "YandexWebmaster", "YandexNews", "YandexVideo", "YandexMedia", "YandexFavicons"},
+		domainSuffixes: []string{".yandex.ru", ".yandex.net", ".yandex.com"},
+	},
+	{
+		name:           "applebot",
+		userAgents:     []string{"Applebot"},
+		domainSuffixes: []string{".applebot.apple.com"},
+		ipRangesURL:    "https://search.developer.apple.com/applebot.json",
+	},
+	{
+		name:        "duckduckbot",
+		userAgents:  []string{"DuckDuckBot", "DuckAssistBot"},
+		ipRangesURL: "https://duckduckgo.com/duckduckbot.json",
+	},
+	{
+		name:           "baiduspider",
+		userAgents:     []string{"Baiduspider"},
+		domainSuffixes: []string{".baidu.com", ".baidu.jp"},
+	},
+}
+
+type verifiedBotsCheckerConfig struct {
+	// field with user agent
+	Field string `yaml:"field"`
+	// names of presets, all presets if empty
+	Bots      []string           `yaml:"bots"`
+	Resolvers resolverListConfig `yaml:"resolver"`
+	// download published IP ranges of bots, ranges are refreshed and cached
+	// like sources of list checker, ranges of bots without PTR records are
+	// always downloaded
+	IPRanges                bool                  `yaml:"ip_ranges"`
+	IPRangesRefreshInterval time.Duration         `yaml:"ip_ranges_refresh_interval"`
+	IPRangesMaxStaleness    time.Duration         `yaml:"ip_ranges_max_staleness"`
+	IPRangesCacheDir        string                `yaml:"ip_ranges_cache_dir"`
+	Cache                   reverseDNSCacheConfig `yaml:"cache"`
+	Async                   reverseDNSAsyncConfig `yaml:"async"`
+}
+
+type verifiedBot struct {
+	botPreset
+	// nil if ranges are not published or not loaded on start
+	ranges *listChecker
+	// nil if bot cannot be verified by reverse DNS
+	rule *reverseDNSCheckerRule
+}
+
+// verifiedBotsChecker whitelist search engines bots and ban clients with
+// user agent of bot which failed verification
+type verifiedBotsChecker struct {
+	field string
+	bots  []verifiedBot
+	rdns  *reverseDNSChecker
+}
+
+func newVerifiedBotsChecker(cfg verifiedBotsCheckerConfig) (*verifiedBotsChecker, error) {
+	return newVerifiedBotsCheckerWithPresets(cfg, botPresets)
+}
+
+func newVerifiedBotsCheckerWithPresets(cfg verifiedBotsCheckerConfig, presets []botPreset) (*verifiedBotsChecker, error) {
+	if cfg.Field == "" {
+		cfg.Field = defaultVerifiedBotsField
+	}
+
+	selected, err := selectBotPresets(presets, cfg.Bots)
+	if err != nil {
+		return nil, err
+	}
+
+	rdnsCfg := reverseDNSCheckerConfig{
+		Cache: cfg.Cache,
+		Async: cfg.Async,
+	}
+
+	bots := make([]verifiedBot, len(selected))
+	ruleIdx := make([]int, len(selected))
+
+	for i, preset := range selected {
+		bots[i].botPreset = preset
+		ruleIdx[i] = -1
+
+		if len(preset.domainSuffixes) > 0 {
+			ruleIdx[i] = len(rdnsCfg.Rules)
+			rdnsCfg.Rules = append(rdnsCfg.Rules, reverseDNSRuleConfig{
+				Field:          cfg.Field,
+				FieldContains:  preset.userAgents,
+				DomainSuffixes: preset.domainSuffixes,
+				Resolvers:      cfg.Resolvers,
+			})
+		}
+
+		// bot without PTR records can be verified only by ranges, so they
+		// are loaded regardless of ip_ranges
+		if (cfg.IPRanges || len(preset.domainSuffixes) == 0) && preset.ipRangesURL != "" {
+			bots[i].ranges, err = newBotIPRanges(cfg, preset.ipRangesURL)
+			if err != nil {
+				// reverse DNS is used if ranges are not available
+				log.Printf("cannot load IP ranges of %s: %v", preset.name, err)
+			}
+		}
+
+		if ruleIdx[i] < 0 && bots[i].ranges == nil {
+			log.Printf("%s cannot be verified, lines with its user agent get no decision", preset.name)
+		}
+	}
+
+	rdns, err := newReverseDNSChecker(rdnsCfg)
+	if err != nil {
+		closeBotIPRanges(bots)
+		return nil, err
+	}
+
+	for i := range bots {
+		if ruleIdx[i] >= 0 {
+			bots[i].rule = &rdns.rules[ruleIdx[i]]
+		}
+	}
+
+	names := make([]string, len(bots))
+	for i, bot := range bots {
+		names[i] = bot.name
+	}
+
+	log.Printf("verified bots field %q: %s", cfg.Field, strings.Join(names, ", "))
+
+	return &verifiedBotsChecker{
+		field: cfg.Field,
+		bots:  bots,
+		rdns:  rdns,
+	}, nil
+}
+
+func selectBotPresets(presets []botPreset, names []string) ([]botPreset, error) {
+	if len(names) == 0 {
+		return presets, nil
+	}
+
+	var selected []botPreset
+
+	for _, name := range names {
+		found := false
+
+		for _, preset := range presets {
+			if strings.EqualFold(preset.name, name) {
+				selected = append(selected, preset)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			supported := make([]string, len(presets))
+			for i, preset := range presets {
+				supported[i] = preset.name
+			}
+
+			return nil, fmt.Errorf("unknown bot %q (supported: %s)", name, strings.Join(supported, ", "))
+		}
+	}
+
+	return selected, nil
+}
+
+func (vb *verifiedBotsChecker) Check(l *logLine) (score harmScore, descision instantDecision) {
+	ua, ok := l.Get(vb.field)
+	if !ok {
+		return 0, decisionNone
+	}
+
+	for i := range vb.bots {
+		bot := &vb.bots[i]
+
+		if !bot.match(ua) {
+			continue
+		}
+
+		l.Set(botField, bot.name)
+
+		// stale ranges are dropped by list checker
+		loaded := bot.ranges != nil && bot.ranges.loaded()
+
+		if loaded {
+			if _, decision := bot.ranges.Check(l); decision == decisionWhitelist {
+				return 0, decisionWhitelist
+			}
+		}
+
+		if bot.rule != nil {
+			return vb.rdns.checkRule(bot.rule, l)
+		}
+
+		// bot can be verified only by IP ranges
+		if loaded {
+			return 0, decisionBan
+		}
+
+		return 0, decisionNone
+	}
+
+	return 0, decisionNone
+}
+
+func (vb *verifiedBotsChecker) setRecheck(recheck chan<- *logLine) {
+	vb.rdns.setRecheck(recheck)
+}
+
+func (vb *verifiedBotsChecker) SaveState() error {
+	return vb.rdns.SaveState()
+}
+
+func (vb *verifiedBotsChecker) Close() error {
+	closeBotIPRanges(vb.bots)
+
+	return vb.rdns.Close()
+}
+
+func (bot *verifiedBot) match(ua string) bool {
+	for _, substr := range bot.userAgents {
+		if strings.Contains(ua, substr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newBotIPRanges list checker with single source of published IP ranges
+func newBotIPRanges(cfg verifiedBotsCheckerConfig, src string) (*listChecker, error) {
+	refreshInterval := defaultBotIPRangesRefreshInterval
+	if cfg.IPRangesRefreshInterval != 0 {
+		refreshInterval = cfg.IPRangesRefreshInterval
+	}
+
+	return newListChecker(listCheckerConfig{
+		Sources: []listCheckerSrcConfig{
+			{
+				Src:             src,
+				Type:            listCheckerSrcTypeGoogleIPRanges,
+				Action:          "whitelist",
+				RefreshInterval: refreshInterval,
+				MaxStaleness:    cfg.IPRangesMaxStaleness,
+			},
+		},
+		CacheDir: cfg.IPRangesCacheDir,
+	})
+}
+
+func closeBotIPRanges(bots []verifiedBot) {
+	for _, bot := range bots {
+		if bot.ranges != nil {
+			bot.ranges.Close()
+		}
+	}
+}
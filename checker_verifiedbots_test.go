@@ -0,0 +1,271 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testBotIPRanges = `{
+  "creationTime": "2021-06-24T00:00:00.000000",
+  "prefixes": [
+    {"ipv4Prefix": "10.0.0.0/8"},
+    {"ipv6Prefix": "2001:db8::/32"},
+    {"ipv4Prefix": "bad prefix"}
+  ]
+}`
+
+func Test_verifiedBotsChecker_Check(t *testing.T) {
+	createDNSServer, closeDNS := dnsMockCreator(t)
+	defer closeDNS()
+
+	ranges := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testBotIPRanges))
+	}))
+	defer ranges.Close()
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	presets := []botPreset{
+		{
+			name:           "testbot",
+			userAgents:     []string{"TestBot"},
+			domainSuffixes: []string{".unittesting.org"},
+		},
+		{
+			name:        "rangebot",
+			userAgents:  []string{"RangeBot"},
+			ipRangesURL: ranges.URL,
+		},
+		{
+			name:        "deadbot",
+			userAgents:  []string{"DeadBot"},
+			ipRangesURL: missing.URL,
+		},
+	}
+
+	newChecker := func(t *testing.T, ipRanges bool) *verifiedBotsChecker {
+		vb, err := newVerifiedBotsCheckerWithPresets(verifiedBotsCheckerConfig{
+			Resolvers: resolverListConfig{
+				addrs: []string{createDNSServer(dnsTestZone)},
+			},
+			IPRanges: ipRanges,
+		}, presets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() {
+			vb.Close()
+		})
+
+		return vb
+	}
+
+	tests := []struct {
+		name         string
+		ipRanges     bool
+		ip           net.IP
+		ua           string
+		wantDecision instantDecision
+		wantBot      string
+	}{
+		{
+			name:         "verified by reverse DNS",
+			ip:           net.IPv4(1, 2, 3, 4),
+			ua:           "Mozilla/5.0 (compatible; TestBot/2.1)",
+			wantDecision: decisionWhitelist,
+			wantBot:      "testbot",
+		},
+		{
+			name:         "impostor failed reverse DNS",
+			ip:           net.IPv4(2, 3, 4, 5),
+			ua:           "Mozilla/5.0 (compatible; TestBot/2.1)",
+			wantDecision: decisionBan,
+			wantBot:      "testbot",
+		},
+		{
+			name:         "verified by IP ranges",
+			ipRanges:     true,
+			ip:           net.IPv4(10, 1, 2, 3),
+			ua:           "RangeBot/1.0",
+			wantDecision: decisionWhitelist,
+			wantBot:      "rangebot",
+		},
+		{
+			name:         "verified by IPv6 ranges",
+			ipRanges:     true,
+			ip:           net.ParseIP("2001:db8::1"),
+			ua:           "RangeBot/1.0",
+			wantDecision: decisionWhitelist,
+			wantBot:      "rangebot",
+		},
+		{
+			name:         "impostor not in IP ranges",
+			ipRanges:     true,
+			ip:           net.IPv4(11, 0, 0, 1),
+			ua:           "RangeBot/1.0",
+			wantDecision: decisionBan,
+			wantBot:      "rangebot",
+		},
+		{
+			name:         "ranges of bot without PTR are loaded without ip_ranges",
+			ip:           net.IPv4(10, 1, 2, 3),
+			ua:           "RangeBot/1.0",
+			wantDecision: decisionWhitelist,
+			wantBot:      "rangebot",
+		},
+		{
+			name:         "impostor of bot without PTR without ip_ranges",
+			ip:           net.IPv4(11, 0, 0, 1),
+			ua:           "RangeBot/1.0",
+			wantDecision: decisionBan,
+			wantBot:      "rangebot",
+		},
+		{
+			name:         "ranges are not loaded",
+			ip:           net.IPv4(11, 0, 0, 1),
+			ua:           "DeadBot/1.0",
+			wantDecision: decisionNone,
+			wantBot:      "deadbot",
+		},
+		{
+			name:         "not a bot",
+			ip:           net.IPv4(2, 3, 4, 5),
+			ua:           "Mozilla/5.0 (X11; Linux x86_64)",
+			wantDecision: decisionNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vb := newChecker(t, tt.ipRanges)
+
+			l := &logLine{
+				ip:     tt.ip,
+				fields: map[string]string{"user_agent": tt.ua},
+			}
+
+			_, decision := vb.Check(l)
+			if decision != tt.wantDecision {
+				t.Errorf("Check() decision = %v, want %v", decision, tt.wantDecision)
+			}
+
+			if bot, _ := l.Get(botField); bot != tt.wantBot {
+				t.Errorf("Check() bot = %q, want %q", bot, tt.wantBot)
+			}
+		})
+	}
+}
+
+func Test_selectBotPresets(t *testing.T) {
+	selected, err := selectBotPresets(botPresets, []string{"Googlebot", "bingbot"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(selected) != 2 || selected[0].name != "googlebot" || selected[1].name != "bingbot" {
+		t.Fatalf("selectBotPresets() = %v", selected)
+	}
+
+	_, err = selectBotPresets(botPresets, []string{"unknownbot"})
+	if err == nil {
+		t.Fatal("selectBotPresets() expected error for unknown bot")
+	}
+}
+
+func Test_botPresets(t *testing.T) {
+	names := map[string]bool{}
+
+	for _, preset := range botPresets {
+		if names[preset.name] {
+			t.Errorf("duplicate preset %q", preset.name)
+		}
+
+		names[preset.name] = true
+
+		if len(preset.userAgents) == 0 {
+			t.Errorf("preset %q has no user agents", preset.name)
+		}
+
+		if len(preset.domainSuffixes) == 0 && preset.ipRangesURL == "" {
+			t.Errorf("preset %q cannot be verified", preset.name)
+		}
+
+		// suffix without leading dot match domains like evilgooglebot.com
+		for _, suffix := range preset.domainSuffixes {
+			if suffix[0] != '.' {
+				t.Errorf("preset %q suffix %q must start with dot", preset.name, suffix)
+			}
+		}
+	}
+}
+
+func Test_verifiedBotsChecker_Check_ipRangesRefresh(t *testing.T) {
+	server := &listServer{content: testBotIPRanges}
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	presets := []botPreset{
+		{
+			name:        "rangebot",
+			userAgents:  []string{"RangeBot"},
+			ipRangesURL: srv.URL,
+		},
+	}
+
+	vb, err := newVerifiedBotsCheckerWithPresets(verifiedBotsCheckerConfig{
+		IPRanges:                true,
+		IPRangesRefreshInterval: time.Millisecond * 10,
+		IPRangesMaxStaleness:    time.Millisecond * 100,
+		IPRangesCacheDir:        t.TempDir(),
+	}, presets)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer vb.Close()
+
+	check := func(ip net.IP) instantDecision {
+		_, decision := vb.Check(&logLine{
+			ip:     ip,
+			fields: map[string]string{"user_agent": "RangeBot/1.0"},
+		})
+
+		return decision
+	}
+
+	waitFor := func(ip net.IP, want instantDecision) {
+		t.Helper()
+
+		deadline := time.Now().Add(time.Second * 5)
+		for check(ip) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Check(%s) = %v, want %v", ip, check(ip), want)
+			}
+
+			time.Sleep(time.Millisecond * 5)
+		}
+	}
+
+	if got := check(net.IPv4(10, 1, 2, 3)); got != decisionWhitelist {
+		t.Fatalf("Check() = %v, want %v", got, decisionWhitelist)
+	}
+
+	// published ranges are changed
+	server.set(func(s *listServer) {
+		s.content = `{"prefixes": [{"ipv4Prefix": "11.0.0.0/8"}]}`
+	})
+
+	waitFor(net.IPv4(11, 0, 0, 1), decisionWhitelist)
+	waitFor(net.IPv4(10, 1, 2, 3), decisionBan)
+
+	// stale ranges are not used to ban bot
+	server.set(func(s *listServer) { s.down = true })
+
+	waitFor(net.IPv4(10, 1, 2, 3), decisionNone)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const checkpointSaveInterval = time.Second * 5
+
+type checkpointRecord struct {
+	inode   uint64
+	offset  int64
+	savedAt time.Time
+}
+
+// logCheckpoint keep read offsets of log files, so after restart log
+// is read from the same place
+type logCheckpoint struct {
+	path string
+	// zero maxCatchup means any old checkpoint is used
+	maxCatchup time.Duration
+
+	mu    *sync.Mutex
+	dirty bool
+	data  map[string]checkpointRecord
+}
+
+func newLogCheckpoint(path string, maxCatchup time.Duration) *logCheckpoint {
+	return &logCheckpoint{
+		path:       path,
+		maxCatchup: maxCatchup,
+		mu:         &sync.Mutex{},
+		data:       map[string]checkpointRecord{},
+	}
+}
+
+func newLogCheckpointFromFile(path string, maxCatchup time.Duration) (*logCheckpoint, error) {
+	cp := newLogCheckpoint(path, maxCatchup)
+
+	if path == "" {
+		return cp, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open checkpoint %q: %w", path, err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	for scanner.Scan() {
+		str := scanner.Text()
+
+		// log path is last because it can contain spaces
+		parts := strings.SplitN(str, " ", 4)
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("cannot parse checkpoint line %q", str)
+		}
+
+		rec := checkpointRecord{}
+
+		rec.inode, err = strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse inode %q: %w", parts[0], err)
+		}
+
+		rec.offset, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse offset %q: %w", parts[1], err)
+		}
+
+		rec.savedAt, err = time.Parse(cacheWriteTimeFormat, parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse time %q: %w", parts[2], err)
+		}
+
+		cp.data[parts[3]] = rec
+	}
+
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("cannot read checkpoint: %w", scanner.Err())
+	}
+
+	return cp, nil
+}
+
+// Offset return offset to resume reading of log, ok is false when log
+// should be read from end
+func (cp *logCheckpoint) Offset(logPath string, fi os.FileInfo, now time.Time) (offset int64, ok bool) {
+	if cp == nil {
+		return 0, false
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	rec, found := cp.data[logPath]
+	if !found {
+		return 0, false
+	}
+
+	if cp.maxCatchup > 0 && now.Sub(rec.savedAt) > cp.maxCatchup {
+		log.Printf("checkpoint for %s is older than %s, skip to end of log", logPath, cp.maxCatchup)
+		return 0, false
+	}
+
+	// log was rotated while botassasin was stopped, new file is read from start
+	if rec.inode != fileInode(fi) {
+		return 0, true
+	}
+
+	// log was truncated while botassasin was stopped
+	if rec.offset > fi.Size() {
+		return 0, true
+	}
+
+	return rec.offset, true
+}
+
+// Update remember read offset of log
+func (cp *logCheckpoint) Update(logPath string, inode uint64, offset int64) {
+	if cp == nil {
+		return
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	cp.data[logPath] = checkpointRecord{
+		inode:   inode,
+		offset:  offset,
+		savedAt: time.Now(),
+	}
+	cp.dirty = true
+}
+
+func (cp *logCheckpoint) writeTo(w io.Writer) (int, error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	for logPath, rec := range cp.data {
+		_, err := fmt.Fprintf(w, "%d %d %s %s\n", rec.inode, rec.offset, rec.savedAt.Format(cacheWriteTimeFormat), logPath)
+		if err != nil {
+			return 0, fmt.Errorf("cannot save checkpoint: %w", err)
+		}
+	}
+
+	cp.dirty = false
+
+	return len(cp.data), nil
+}
+
+func (cp *logCheckpoint) isDirty() bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	return cp.dirty
+}
+
+// Save write checkpoint to disk if it was changed
+func (cp *logCheckpoint) Save() error {
+	if cp == nil || cp.path == "" || !cp.isDirty() {
+		return nil
+	}
+
+	return writeFileAtomic(cp.path, func(w io.Writer) error {
+		_, err := cp.writeTo(w)
+		return err
+	})
+}
+
+func (cp *logCheckpoint) saver(stop <-chan struct{}) {
+	if cp == nil || cp.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(checkpointSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := cp.Save()
+		if err != nil {
+			log.Printf("cannot save checkpoint: %v", err)
+		}
+	}
+}
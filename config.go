@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"io"
+	"os"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -14,16 +16,47 @@ type configBlockAction struct {
 	params []string
 }
 
+// configLogSource input of log lines with optional own log format
+type configLogSource struct {
+	// file (default), stdin, fifo or syslog
+	Type string `yaml:"type"`
+	// path or glob pattern for file, path for fifo
+	Path string `yaml:"path"`
+	// syslog listen address (ex. udp://0.0.0.0:514)
+	Listen    string `yaml:"listen"`
+	LogFormat string `yaml:"log_format"`
+}
+
+// configLogSources single path or list of sources
+type configLogSources struct {
+	sources []configLogSource
+}
+
+// configBanSteps list of ban durations, "permanent" means ban forever
+type configBanSteps struct {
+	steps []time.Duration
+}
+
 type config struct {
-	Debug              bool              `yaml:"debug"`
-	MetricsAddr        string            `yaml:"metrics_addr"`
-	Logfile            string            `yaml:"logfile"`
-	LogFormat          string            `yaml:"log_format"`
-	Checkers           []checkerConfig   `yaml:"checkers"`
-	BlockAction        configBlockAction `yaml:"block_action"`
-	Blocklog           string            `yaml:"blocklog"`
-	BlocklogTemplate   string            `yaml:"blocklog_template"`
-	WhitelistCachePath string            `yaml:"whitelist_cache_path"`
+	Debug                bool              `yaml:"debug"`
+	MetricsAddr          string            `yaml:"metrics_addr"`
+	ReloadToken          string            `yaml:"reload_token"`
+	Logfile              configLogSources  `yaml:"logfile"`
+	LogFormat            string            `yaml:"log_format"`
+	CheckpointPath       string            `yaml:"checkpoint_path"`
+	CheckpointMaxCatchup time.Duration     `yaml:"checkpoint_max_catchup"`
+	Checkers             []checkerConfig   `yaml:"checkers"`
+	BlockAction          configBlockAction `yaml:"block_action"`
+	UnblockAction        configBlockAction `yaml:"unblock_action"`
+	BanDuration          time.Duration     `yaml:"ban_duration"`
+	BanEscalation        configBanSteps    `yaml:"ban_escalation"`
+	BanLedgerPath        string            `yaml:"ban_ledger_path"`
+	BanForgetAfter       time.Duration     `yaml:"ban_forget_after"`
+	Blocklog             string            `yaml:"blocklog"`
+	BlocklogTemplate     string            `yaml:"blocklog_template"`
+	WhitelistCachePath   string            `yaml:"whitelist_cache_path"`
+	WhitelistCacheTTL    time.Duration     `yaml:"whitelist_cache_ttl"`
+	WhitelistCacheSize   int               `yaml:"whitelist_cache_size"`
 }
 
 func loadConfig(r io.Reader) (config, error) {
@@ -36,9 +69,40 @@ func loadConfig(r io.Reader) (config, error) {
 		return config{}, fmt.Errorf("cannot decode config: %w", err)
 	}
 
+	err = validateConfig(cfg)
+	if err != nil {
+		return config{}, err
+	}
+
 	return cfg, nil
 }
 
+// validateConfig check options which depend on each other
+func validateConfig(cfg config) error {
+	if len(cfg.UnblockAction.params) > 0 {
+		return nil
+	}
+
+	for _, d := range cfg.BanEscalation.Steps(cfg.BanDuration) {
+		if d > 0 {
+			return fmt.Errorf("ban_duration and ban_escalation require unblock_action, otherwise expired bans are never unblocked")
+		}
+	}
+
+	return nil
+}
+
+func loadConfigFile(path string) (config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return config{}, fmt.Errorf("cannot open config file %s: %w", path, err)
+	}
+
+	defer f.Close()
+
+	return loadConfig(f)
+}
+
 func (c *configBlockAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
 
@@ -63,3 +127,100 @@ func (c *configBlockAction) UnmarshalYAML(unmarshal func(interface{}) error) err
 func (c configBlockAction) String() string {
 	return strings.Join(c.params, " ")
 }
+
+func (c *configLogSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+
+	err := unmarshal(&s)
+	if err == nil {
+		c.Path = s
+		return nil
+	}
+
+	// avoid recursive UnmarshalYAML call
+	type plain configLogSource
+
+	return unmarshal((*plain)(c))
+}
+
+func (c *configLogSources) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+
+	err := unmarshal(&s)
+	if err == nil {
+		c.sources = []configLogSource{{Path: s}}
+		return nil
+	}
+
+	return unmarshal(&c.sources)
+}
+
+func (c configLogSources) String() string {
+	var paths []string
+
+	for _, src := range c.sources {
+		paths = append(paths, src.String())
+	}
+
+	return strings.Join(paths, ", ")
+}
+
+func (c configLogSource) String() string {
+	switch c.Type {
+	case inputTypeStdin:
+		return inputTypeStdin
+	case inputTypeSyslog:
+		return inputTypeSyslog + " " + c.Listen
+	default:
+		return c.Path
+	}
+}
+
+func (c *configBanSteps) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var strs []string
+
+	err := unmarshal(&strs)
+	if err != nil {
+		return err
+	}
+
+	for _, str := range strs {
+		if str == permanentBanMark {
+			c.steps = append(c.steps, 0)
+			continue
+		}
+
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("cannot parse ban duration %q: %w", str, err)
+		}
+
+		c.steps = append(c.steps, d)
+	}
+
+	return nil
+}
+
+// Steps return escalation steps or single step with fallback duration
+func (c configBanSteps) Steps(fallback time.Duration) []time.Duration {
+	if len(c.steps) == 0 {
+		return []time.Duration{fallback}
+	}
+
+	return c.steps
+}
+
+func (c configBanSteps) String() string {
+	var strs []string
+
+	for _, d := range c.steps {
+		if d == 0 {
+			strs = append(strs, permanentBanMark)
+			continue
+		}
+
+		strs = append(strs, d.String())
+	}
+
+	return strings.Join(strs, ", ")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_loadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "permanent ban without unblock action",
+			content: "block_action: echo\n",
+		},
+		{
+			name:    "ban duration with unblock action",
+			content: "block_action: echo\nunblock_action: echo\nban_duration: 1h\n",
+		},
+		{
+			name:    "ban duration without unblock action",
+			content: "block_action: echo\nban_duration: 1h\n",
+			wantErr: true,
+		},
+		{
+			name:    "permanent escalation without unblock action",
+			content: "block_action: echo\nban_escalation: [permanent]\n",
+		},
+		{
+			name:    "ban escalation without unblock action",
+			content: "block_action: echo\nban_escalation: [1h, permanent]\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfig(strings.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "os"
+
+// inode is not available on windows, checkpoint is matched only by offset
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
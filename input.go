@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	inputTypeFile   = "file"
+	inputTypeStdin  = "stdin"
+	inputTypeFIFO   = "fifo"
+	inputTypeSyslog = "syslog"
+
+	stdinSourceName = "stdin"
+
+	// nginx lines with long user agent and referer can be bigger than
+	// default bufio.Scanner buffer
+	maxLineSize = 1024 * 1024
+)
+
+var (
+	_ lineSource = &logWatcher{}
+	_ lineSource = &readerSource{}
+	_ lineSource = &syslogSource{}
+	_ lineSource = &mergedSource{}
+)
+
+// lineSource is input of log lines for appcore
+type lineSource interface {
+	C() <-chan *logLine
+	Err() error
+}
+
+func newLineSourceFromConfig(ctx context.Context, cfg config, rotated rotationCounter, checkpoint *logCheckpoint) (lineSource, error) {
+	var sources []lineSource
+	var files []logWatcherSource
+
+	for _, src := range cfg.Logfile.sources {
+		format := cfg.LogFormat
+		if src.LogFormat != "" {
+			format = src.LogFormat
+		}
+
+		parser, err := newLogParser(format)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create log parser for %s: %w", src, err)
+		}
+
+		log.Printf("log %s format: %s", src, format)
+
+		switch src.Type {
+		case "", inputTypeFile:
+			files = append(files, logWatcherSource{
+				pattern: src.Path,
+				parser:  parser,
+			})
+
+		case inputTypeStdin:
+			sources = append(sources, newStdinSource(ctx, parser))
+
+		case inputTypeFIFO:
+			fifo, err := newFIFOSource(ctx, src.Path, parser)
+			if err != nil {
+				return nil, err
+			}
+
+			sources = append(sources, fifo)
+
+		case inputTypeSyslog:
+			syslog, err := newSyslogSource(ctx, src.Listen, parser)
+			if err != nil {
+				return nil, err
+			}
+
+			sources = append(sources, syslog)
+
+		default:
+			return nil, fmt.Errorf("unknown log type %q (supported types %v)", src.Type, []string{inputTypeFile, inputTypeStdin, inputTypeFIFO, inputTypeSyslog})
+		}
+	}
+
+	if len(files) > 0 {
+		watcher, err := newLogWatcher(ctx, files, rotated, checkpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, watcher)
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no log sources")
+	}
+
+	return newMergedSource(sources...), nil
+}
+
+// drainContext is cancelled when timeout is over after ctx is cancelled,
+// so lines already written are sent on shutdown, but not forever
+func drainContext(ctx context.Context, timeout time.Duration) context.Context {
+	drain, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		defer cancel()
+
+		<-ctx.Done()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		<-timer.C
+	}()
+
+	return drain
+}
+
+// readerSource read lines from stdin or named pipe
+type readerSource struct {
+	ctx    context.Context
+	name   string
+	parser *logParser
+
+	mu  *sync.Mutex
+	err error
+
+	// open return reader, for named pipe it is called again when writer
+	// close pipe
+	open   func() (io.ReadCloser, error)
+	reopen bool
+}
+
+func newStdinSource(ctx context.Context, parser *logParser) *readerSource {
+	return &readerSource{
+		ctx:    ctx,
+		name:   stdinSourceName,
+		parser: parser,
+		mu:     &sync.Mutex{},
+		open: func() (io.ReadCloser, error) {
+			return io.NopCloser(os.Stdin), nil
+		},
+	}
+}
+
+func newFIFOSource(ctx context.Context, path string, parser *logParser) (*readerSource, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot stat %s: %w", path, err)
+	}
+
+	if stat.Mode()&os.ModeNamedPipe == 0 {
+		return nil, fmt.Errorf("%s is not named pipe", path)
+	}
+
+	return &readerSource{
+		ctx:    ctx,
+		name:   path,
+		parser: parser,
+		mu:     &sync.Mutex{},
+		open: func() (io.ReadCloser, error) {
+			// block until writer open pipe
+			return os.Open(path)
+		},
+		reopen: true,
+	}, nil
+}
+
+func (r *readerSource) C() <-chan *logLine {
+	c := make(chan *logLine)
+	lines := make(chan *logLine)
+
+	go r.readAll(lines)
+
+	// reading of stdin or opening of pipe can't be interrupted, so on
+	// shutdown reader is left blocked
+	go func() {
+		defer close(c)
+
+		for {
+			select {
+			case l, ok := <-lines:
+				if !ok {
+					return
+				}
+
+				c <- l
+
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+func (r *readerSource) readAll(lines chan *logLine) {
+	defer close(lines)
+
+	for {
+		rc, err := r.open()
+		if err != nil {
+			r.setErr(fmt.Errorf("cannot open %s: %w", r.name, err))
+			return
+		}
+
+		err = r.read(rc, lines)
+		rc.Close()
+
+		if err != nil {
+			r.setErr(err)
+			return
+		}
+
+		if !r.reopen || r.ctx.Err() != nil {
+			log.Printf("%s closed", r.name)
+			return
+		}
+	}
+}
+
+func (r *readerSource) read(rd io.Reader, lines chan *logLine) error {
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineSize)
+
+	for scanner.Scan() {
+		str := strings.TrimRight(scanner.Text(), "\r")
+		if str == "" {
+			continue
+		}
+
+		l := r.parser.Parse(str)
+		l.source = r.name
+
+		select {
+		case lines <- l:
+		case <-r.ctx.Done():
+			return nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read line from %s: %w", r.name, err)
+	}
+
+	return nil
+}
+
+func (r *readerSource) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+func (r *readerSource) setErr(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.mu.Unlock()
+}
+
+// mergedSource read lines from all sources into single channel
+type mergedSource struct {
+	sources []lineSource
+}
+
+func newMergedSource(sources ...lineSource) lineSource {
+	if len(sources) == 1 {
+		return sources[0]
+	}
+
+	return &mergedSource{sources: sources}
+}
+
+func (m *mergedSource) C() <-chan *logLine {
+	c := make(chan *logLine)
+	wg := &sync.WaitGroup{}
+
+	for _, src := range m.sources {
+		wg.Add(1)
+
+		go func(src lineSource) {
+			defer wg.Done()
+
+			for l := range src.C() {
+				c <- l
+			}
+		}(src)
+	}
+
+	go func() {
+		wg.Wait()
+		close(c)
+	}()
+
+	return c
+}
+
+func (m *mergedSource) Err() error {
+	for _, src := range m.sources {
+		if err := src.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+// big enough for any UDP datagram
+const syslogMaxPacketSize = 65536
+
+// syslogSource receive log lines as syslog messages (RFC3164 or RFC5424),
+// envelope is stripped before message is parsed
+type syslogSource struct {
+	ctx context.Context
+	// messages are not sent when shutdown timeout is over
+	drain  context.Context
+	addr   string
+	parser *logParser
+
+	mu  *sync.Mutex
+	err error
+
+	packetConn net.PacketConn
+	listener   net.Listener
+}
+
+// newSyslogSource start listen address in format udp://host:port,
+// tcp://host:port, unix:///path/to/socket or unixgram:///path/to/socket
+func newSyslogSource(ctx context.Context, listen string, parser *logParser) (*syslogSource, error) {
+	u, err := url.Parse(listen)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse listen address %q: %w", listen, err)
+	}
+
+	s := &syslogSource{
+		ctx:    ctx,
+		drain:  drainContext(ctx, shutdownTimeout),
+		parser: parser,
+		mu:     &sync.Mutex{},
+	}
+
+	switch u.Scheme {
+	case "udp", "udp4", "udp6":
+		s.addr = u.Host
+		s.packetConn, err = net.ListenPacket(u.Scheme, s.addr)
+
+	case "unixgram":
+		s.addr = u.Path
+		os.Remove(s.addr)
+		s.packetConn, err = net.ListenPacket(u.Scheme, s.addr)
+
+	case "tcp", "tcp4", "tcp6":
+		s.addr = u.Host
+		s.listener, err = net.Listen(u.Scheme, s.addr)
+
+	case "unix":
+		s.addr = u.Path
+		os.Remove(s.addr)
+		s.listener, err = net.Listen(u.Scheme, s.addr)
+
+	default:
+		return nil, fmt.Errorf("unsupported network %q (supported: udp, tcp, unix, unixgram)", u.Scheme)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen %s: %w", listen, err)
+	}
+
+	log.Printf("syslog listen %s", listen)
+
+	return s, nil
+}
+
+func (s *syslogSource) C() <-chan *logLine {
+	c := make(chan *logLine)
+
+	go func() {
+		<-s.ctx.Done()
+
+		if s.packetConn != nil {
+			s.packetConn.Close()
+		}
+
+		if s.listener != nil {
+			s.listener.Close()
+		}
+	}()
+
+	go func() {
+		defer close(c)
+
+		if s.packetConn != nil {
+			s.readPackets(c)
+			return
+		}
+
+		s.accept(c)
+	}()
+
+	return c
+}
+
+func (s *syslogSource) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *syslogSource) setErr(err error) {
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+func (s *syslogSource) readPackets(c chan *logLine) {
+	buf := make([]byte, syslogMaxPacketSize)
+
+	for {
+		n, _, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			s.setErr(fmt.Errorf("cannot read syslog message: %w", err))
+			return
+		}
+
+		if !s.send(c, string(buf[:n])) {
+			return
+		}
+	}
+}
+
+func (s *syslogSource) accept(c chan *logLine) {
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.setErr(fmt.Errorf("cannot accept syslog connection: %w", err))
+			return
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+
+			// close connection on shutdown
+			stop := make(chan struct{})
+			defer close(stop)
+
+			go func() {
+				select {
+				case <-s.ctx.Done():
+					conn.Close()
+				case <-stop:
+				}
+			}()
+
+			err := s.readStream(conn, c)
+			if err != nil && s.ctx.Err() == nil {
+				log.Printf("syslog connection %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// readStream read messages framed by octet counting (RFC6587) or
+// separated by new line
+func (s *syslogSource) readStream(conn net.Conn, c chan *logLine) error {
+	r := bufio.NewReader(conn)
+
+	for {
+		first, err := r.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var msg string
+
+		octetCounted := false
+		if first[0] >= '0' && first[0] <= '9' {
+			octetCounted, err = isOctetCounted(r)
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+
+		if octetCounted {
+			strLen, err := r.ReadString(' ')
+			if err != nil {
+				return err
+			}
+
+			size, err := strconv.Atoi(strings.TrimSpace(strLen))
+			if err != nil || size <= 0 || size > maxLineSize {
+				return fmt.Errorf("bad message length %q", strLen)
+			}
+
+			buf := make([]byte, size)
+
+			_, err = io.ReadFull(r, buf)
+			if err != nil {
+				return err
+			}
+
+			msg = string(buf)
+		} else {
+			msg, err = r.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return err
+			}
+		}
+
+		if !s.send(c, msg) {
+			return nil
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// isOctetCounted check that buffered stream start with "<length> <", so
+// plain lines starting with digits (ex. IP) are not taken as message length
+func isOctetCounted(r *bufio.Reader) (bool, error) {
+	maxDigits := len(strconv.Itoa(maxLineSize))
+
+	for i := 1; i <= maxDigits+1; i++ {
+		// bytes are peeked one by one, so short line does not wait for next
+		buf, err := r.Peek(i + 1)
+		if err != nil {
+			return false, err
+		}
+
+		c := buf[i-1]
+
+		switch {
+		case c >= '0' && c <= '9':
+			continue
+		case c == ' ' && i > 1:
+			return buf[i] == '<', nil
+		default:
+			return false, nil
+		}
+	}
+
+	return false, nil
+}
+
+// send return false if message is not sent before shutdown timeout
+func (s *syslogSource) send(c chan *logLine, msg string) bool {
+	str := strings.TrimRight(stripSyslogEnvelope(msg), "\r\n\x00")
+	if str == "" {
+		return true
+	}
+
+	l := s.parser.Parse(str)
+	l.source = inputTypeSyslog
+
+	select {
+	case c <- l:
+		return true
+	case <-s.drain.Done():
+		return false
+	}
+}
+
+// stripSyslogEnvelope return message part of RFC5424 or RFC3164 syslog
+// message, message without priority is returned as is
+func stripSyslogEnvelope(msg string) string {
+	if !strings.HasPrefix(msg, "<") {
+		return msg
+	}
+
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return msg
+	}
+
+	if _, err := strconv.Atoi(msg[1:end]); err != nil {
+		return msg
+	}
+
+	rest := msg[end+1:]
+
+	// RFC5424 message start with version
+	if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		return stripRFC5424Header(rest[2:])
+	}
+
+	return stripRFC3164Header(rest)
+}
+
+// stripRFC5424Header skip TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA
+func stripRFC5424Header(str string) string {
+	for i := 0; i < 5; i++ {
+		sp := strings.IndexByte(str, ' ')
+		if sp == -1 {
+			return ""
+		}
+
+		str = str[sp+1:]
+	}
+
+	// structured data is nil value or one or more [elements]
+	if strings.HasPrefix(str, "-") {
+		str = str[1:]
+	} else {
+		for strings.HasPrefix(str, "[") {
+			end := structuredDataEnd(str)
+			if end == -1 {
+				return ""
+			}
+
+			str = str[end+1:]
+		}
+	}
+
+	str = strings.TrimPrefix(str, " ")
+
+	// UTF-8 byte order mark
+	return strings.TrimPrefix(str, "\ufeff")
+}
+
+// structuredDataEnd return index of ']' closing element, escaped \] is skipped
+func structuredDataEnd(str string) int {
+	for i := 1; i < len(str); i++ {
+		switch str[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// stripRFC3164Header skip "Mmm dd hh:mm:ss HOSTNAME TAG: "
+func stripRFC3164Header(str string) string {
+	// timestamp has fixed length, day is padded with space
+	const timestampLen = len("Jan _2 15:04:05")
+
+	if len(str) <= timestampLen || str[3] != ' ' || str[timestampLen] != ' ' {
+		return str
+	}
+
+	str = str[timestampLen+1:]
+
+	// hostname
+	sp := strings.IndexByte(str, ' ')
+	if sp == -1 {
+		return str
+	}
+
+	str = str[sp+1:]
+
+	// tag is terminated by colon, ex. "nginx:" or "haproxy[123]:"
+	colon := strings.Index(str, ": ")
+	if colon == -1 || strings.ContainsAny(str[:colon], " ") {
+		return str
+	}
+
+	return str[colon+2:]
+}
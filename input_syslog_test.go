@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+const syslogTestLine = `83.149.21.43 - - [24/Jun/2021:12:02:44 +0000] "GET / HTTP/2.0" 200 7465 "-" "Mozilla/5.0" rt=0.074`
+
+func Test_stripSyslogEnvelope(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{
+			name: "no envelope",
+			msg:  syslogTestLine,
+			want: syslogTestLine,
+		},
+		{
+			name: "nginx RFC3164",
+			msg:  "<190>Jun 24 12:02:44 web1 nginx: " + syslogTestLine,
+			want: syslogTestLine,
+		},
+		{
+			name: "RFC3164 padded day and pid",
+			msg:  "<134>Jun  4 12:02:44 lb1 haproxy[1234]: " + syslogTestLine,
+			want: syslogTestLine,
+		},
+		{
+			name: "RFC5424 without structured data",
+			msg:  "<165>1 2021-06-24T12:02:44.003Z web1 nginx 1234 - - " + syslogTestLine,
+			want: syslogTestLine,
+		},
+		{
+			name: "RFC5424 with structured data",
+			msg:  `<165>1 2021-06-24T12:02:44.003Z web1 nginx - ID47 [exampleSDID@32473 iut="3" eventSource="App\]lication"][meta seq="1"] ` + syslogTestLine,
+			want: syslogTestLine,
+		},
+		{
+			name: "RFC5424 with BOM",
+			msg:  "<165>1 2021-06-24T12:02:44.003Z web1 nginx - - - \ufeff" + syslogTestLine,
+			want: syslogTestLine,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripSyslogEnvelope(tt.msg); got != tt.want {
+				t.Errorf("stripSyslogEnvelope() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_syslogSource_C(t *testing.T) {
+	tests := []struct {
+		name   string
+		listen string
+		send   func(conn net.Conn) error
+	}{
+		{
+			name:   "udp",
+			listen: "udp://127.0.0.1:0",
+			send: func(conn net.Conn) error {
+				_, err := fmt.Fprintf(conn, "<190>Jun 24 12:02:44 web1 nginx: %s", syslogTestLine)
+				return err
+			},
+		},
+		{
+			name:   "tcp new line",
+			listen: "tcp://127.0.0.1:0",
+			send: func(conn net.Conn) error {
+				_, err := fmt.Fprintf(conn, "<190>Jun 24 12:02:44 web1 nginx: %s\n", syslogTestLine)
+				return err
+			},
+		},
+		{
+			name:   "tcp plain line",
+			listen: "tcp://127.0.0.1:0",
+			send: func(conn net.Conn) error {
+				_, err := fmt.Fprintf(conn, "%s\n", syslogTestLine)
+				return err
+			},
+		},
+		{
+			name:   "tcp octet counting",
+			listen: "tcp://127.0.0.1:0",
+			send: func(conn net.Conn) error {
+				msg := "<165>1 2021-06-24T12:02:44.003Z web1 nginx - - - " + syslogTestLine
+				_, err := fmt.Fprintf(conn, "%d %s", len(msg), msg)
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, err := newLogParser(`^(?P<ip>\S+) .*"(?P<user_agent>[^"]*)" rt.*$`)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			src, err := newSyslogSource(ctx, tt.listen, parser)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := src.C()
+
+			var conn net.Conn
+			if src.packetConn != nil {
+				conn, err = net.Dial("udp", src.packetConn.LocalAddr().String())
+			} else {
+				conn, err = net.Dial("tcp", src.listener.Addr().String())
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			err = tt.send(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l := expectSource(t, c, inputTypeSyslog)
+
+			if !l.IP().Equal(net.ParseIP("83.149.21.43")) {
+				t.Errorf("got ip %s, want 83.149.21.43", l.IP())
+			}
+
+			if ua, _ := l.Get("user_agent"); ua != "Mozilla/5.0" {
+				t.Errorf("got user_agent %q, want Mozilla/5.0", ua)
+			}
+		})
+	}
+}
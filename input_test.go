@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestLogParser(t *testing.T) *logParser {
+	t.Helper()
+
+	parser, err := newLogParser(`^(?P<ip>\S+) .*"(?P<user_agent>[^"]*)" rt.*$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parser
+}
+
+func Test_readerSource_C(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		wantIPs []string
+	}{
+		{
+			name:    "lines",
+			input:   syslogTestLine + "\n" + strings.Replace(syslogTestLine, "83.149.21.43", "10.0.0.1", 1) + "\n",
+			wantIPs: []string{"83.149.21.43", "10.0.0.1"},
+		},
+		{
+			name:    "empty lines and CRLF",
+			input:   "\n" + syslogTestLine + "\r\n\r\n",
+			wantIPs: []string{"83.149.21.43"},
+		},
+		{
+			name:    "last line without new line",
+			input:   syslogTestLine,
+			wantIPs: []string{"83.149.21.43"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			src := newStdinSource(ctx, newTestLogParser(t))
+			src.open = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(strings.NewReader(tt.input)), nil
+			}
+
+			var got []string
+			for l := range src.C() {
+				if l.source != stdinSourceName {
+					t.Errorf("got source %q, want %q", l.source, stdinSourceName)
+				}
+
+				got = append(got, l.IP().String())
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantIPs) {
+				t.Errorf("got IPs %v, want %v", got, tt.wantIPs)
+			}
+
+			if err := src.Err(); err != nil {
+				t.Errorf("Err() = %v", err)
+			}
+		})
+	}
+}
+
+func Test_newFIFOSource(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := newFIFOSource(context.Background(), filepath.Join(dir, "missing"), newTestLogParser(t))
+	if err == nil {
+		t.Error("no error for missing pipe")
+	}
+
+	regular := filepath.Join(dir, "regular")
+	if err := ioutil.WriteFile(regular, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newFIFOSource(context.Background(), regular, newTestLogParser(t))
+	if err == nil {
+		t.Error("no error for regular file")
+	}
+}
+
+func Test_readerSource_C_fifo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.fifo")
+
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skipf("cannot create named pipe: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	src, err := newFIFOSource(ctx, path, newTestLogParser(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := src.C()
+
+	// pipe is opened again after writer close it
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		w, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = fmt.Fprintln(w, strings.Replace(syslogTestLine, "83.149.21.43", ip, 1))
+		w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case l := <-c:
+			if l.source != path {
+				t.Errorf("got source %q, want %q", l.source, path)
+			}
+
+			if l.IP().String() != ip {
+				t.Errorf("got ip %s, want %s", l.IP(), ip)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("line of %s is not read from pipe", ip)
+		}
+	}
+}
@@ -11,11 +11,12 @@ func _() {
 	_ = x[decisionNone-0]
 	_ = x[decisionBan-1]
 	_ = x[decisionWhitelist-2]
+	_ = x[decisionHold-3]
 }
 
-const _instantDecision_name = "decisionNonedecisionBandecisionWhitelist"
+const _instantDecision_name = "decisionNonedecisionBandecisionWhitelistdecisionHold"
 
-var _instantDecision_index = [...]uint8{0, 12, 23, 40}
+var _instantDecision_index = [...]uint8{0, 12, 23, 40, 52}
 
 func (i instantDecision) String() string {
 	if i < 0 || i >= instantDecision(len(_instantDecision_index)-1) {
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	defaultWhitelistCacheTTL  = time.Hour * 24
+	defaultWhitelistCacheSize = 100000
+
+	// written instead of empty source
+	noSourceMark = "-"
+)
+
+type ipCacheConfig struct {
+	path string
+	// zero ttl means entries never expire
+	ttl time.Duration
+	// ttl of entries with specified source, overrides ttl
+	sourceTTL map[string]time.Duration
+	// zero maxSize means unlimited cache
+	maxSize int
+}
+
+type ipCacheEntry struct {
+	ip     string
+	added  time.Time
+	source string
+}
+
+// ipCache set of IPs with optional TTL and LRU eviction
+type ipCache struct {
+	path      string
+	ttl       time.Duration
+	sourceTTL map[string]time.Duration
+	maxSize   int
+
+	mu   *sync.Mutex
+	data map[string]*list.Element
+	// most recently used entries at front
+	lru *list.List
+}
+
+// TODO: replace string with function that return writer
+func newIPCache(cfg ipCacheConfig) *ipCache {
+	return &ipCache{
+		path:      cfg.path,
+		ttl:       cfg.ttl,
+		sourceTTL: cfg.sourceTTL,
+		maxSize:   cfg.maxSize,
+		mu:        &sync.Mutex{},
+		data:      map[string]*list.Element{},
+		lru:       list.New(),
+	}
+}
+
+func newIPCaheFromFile(cfg ipCacheConfig) (*ipCache, error) {
+	if cfg.path == "" {
+		return newIPCache(cfg), nil
+	}
+
+	f, err := os.OpenFile(cfg.path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open cache file %q: %w", cfg.path, err)
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+
+	cache := newIPCache(cfg)
+	now := time.Now()
+
+	for scanner.Scan() {
+		str := scanner.Text()
+
+		// source is missing in old cache files
+		parts := strings.Fields(str)
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, fmt.Errorf("cannot parse cache line %q", str)
+		}
+
+		t, err := time.Parse(cacheWriteTimeFormat, parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse time %q: %w", parts[1], err)
+		}
+
+		source := noSourceMark
+		if len(parts) == 3 {
+			source = parts[2]
+		}
+
+		if cache.expired(t, source, now) {
+			continue
+		}
+
+		cache.addWithTime(parts[0], t, source)
+	}
+
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("cannot read cache: %w", scanner.Err())
+	}
+
+	log.Printf("%d records loaded from cache %s", len(cache.data), cfg.path)
+
+	return cache, nil
+}
+
+func (c *ipCache) Contains(ip net.IP) bool {
+	_, ok := c.Lookup(ip)
+
+	return ok
+}
+
+func (c *ipCache) containsKey(key string) bool {
+	_, ok := c.lookupKey(key)
+
+	return ok
+}
+
+// Lookup return source of cached IP, expired entries are removed
+func (c *ipCache) Lookup(ip net.IP) (string, bool) {
+	return c.lookupKey(ip.String())
+}
+
+func (c *ipCache) lookupKey(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.data[key]
+	if !ok {
+		return "", false
+	}
+
+	entry := el.Value.(*ipCacheEntry)
+
+	if c.expired(entry.added, entry.source, time.Now()) {
+		c.remove(el)
+		return "", false
+	}
+
+	c.lru.MoveToFront(el)
+
+	return entry.source, true
+}
+
+func (c *ipCache) Add(ip net.IP) {
+	c.AddSource(ip, noSourceMark)
+}
+
+// AddSource add IP with source of decision (ex. checker name)
+func (c *ipCache) AddSource(ip net.IP, source string) {
+	c.addKey(ip.String(), source)
+}
+
+// addKey add IP or subnet in CIDR notation
+func (c *ipCache) addKey(key string, source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.addWithTime(key, time.Now(), source)
+}
+
+func (c *ipCache) Remove(ip net.IP) {
+	c.removeKey(ip.String())
+}
+
+func (c *ipCache) removeKey(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.data[key]
+	if ok {
+		c.remove(el)
+	}
+}
+
+func (c *ipCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.data)
+}
+
+func (c *ipCache) addWithTime(key string, t time.Time, source string) {
+	if source == "" {
+		source = noSourceMark
+	}
+
+	if el, ok := c.data[key]; ok {
+		entry := el.Value.(*ipCacheEntry)
+		entry.added = t
+		entry.source = source
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.data[key] = c.lru.PushFront(&ipCacheEntry{
+		ip:     key,
+		added:  t,
+		source: source,
+	})
+
+	// evict least recently used
+	for c.maxSize > 0 && len(c.data) > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *ipCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*ipCacheEntry)
+	delete(c.data, entry.ip)
+}
+
+func (c *ipCache) expired(added time.Time, source string, now time.Time) bool {
+	ttl := c.ttl
+	if sourceTTL, ok := c.sourceTTL[source]; ok {
+		ttl = sourceTTL
+	}
+
+	return ttl > 0 && now.Sub(added) > ttl
+}
+
+func (c *ipCache) writeTo(w io.Writer) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// least recently used first, so they evicted first on load if cache shrink
+	for el := c.lru.Back(); el != nil; el = el.Prev() {
+		entry := el.Value.(*ipCacheEntry)
+
+		_, err := fmt.Fprintf(w, "%s %s %s\n", entry.ip, entry.added.Format(cacheWriteTimeFormat), entry.source)
+		if err != nil {
+			return 0, fmt.Errorf("cannot save cache: %w", err)
+		}
+	}
+
+	return len(c.data), nil
+}
+
+// Save write cache to disk atomically
+func (c *ipCache) Save() (int, error) {
+	if c.path == "" {
+		return 0, nil
+	}
+
+	var count int
+
+	err := writeFileAtomic(c.path, func(w io.Writer) error {
+		var err error
+		count, err = c.writeTo(w)
+		return err
+	})
+
+	return count, err
+}
+
+func (c *ipCache) saver(stop <-chan struct{}) {
+	if c.path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		count, err := c.Save()
+		if err != nil {
+			log.Printf("cannot save cache: %v", err)
+			continue
+		}
+
+		log.Printf("cache saved %d records", count)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ipCache_Lookup(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        ipCacheConfig
+		added      time.Time
+		wantSource string
+		wantOk     bool
+	}{
+		{
+			name:       "no ttl",
+			cfg:        ipCacheConfig{},
+			added:      time.Now().Add(-time.Hour * 24 * 365),
+			wantSource: "reverse_dns",
+			wantOk:     true,
+		},
+		{
+			name:       "fresh entry",
+			cfg:        ipCacheConfig{ttl: time.Hour},
+			added:      time.Now().Add(-time.Minute),
+			wantSource: "reverse_dns",
+			wantOk:     true,
+		},
+		{
+			name:       "expired entry",
+			cfg:        ipCacheConfig{ttl: time.Hour},
+			added:      time.Now().Add(-time.Hour * 2),
+			wantSource: "",
+			wantOk:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newIPCache(tt.cfg)
+			c.addWithTime("1.2.3.4", tt.added, "reverse_dns")
+
+			gotSource, gotOk := c.Lookup(net.IPv4(1, 2, 3, 4))
+			if gotSource != tt.wantSource {
+				t.Errorf("ipCache.Lookup() gotSource = %v, want %v", gotSource, tt.wantSource)
+			}
+			if gotOk != tt.wantOk {
+				t.Errorf("ipCache.Lookup() gotOk = %v, want %v", gotOk, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_ipCache_Evict(t *testing.T) {
+	c := newIPCache(ipCacheConfig{maxSize: 2})
+
+	c.AddSource(net.IPv4(1, 1, 1, 1), "list")
+	c.AddSource(net.IPv4(2, 2, 2, 2), "list")
+
+	// 1.1.1.1 become most recently used
+	c.Lookup(net.IPv4(1, 1, 1, 1))
+
+	c.AddSource(net.IPv4(3, 3, 3, 3), "list")
+
+	if c.Len() != 2 {
+		t.Errorf("ipCache.Len() = %d, want 2", c.Len())
+	}
+
+	if c.Contains(net.IPv4(2, 2, 2, 2)) {
+		t.Errorf("least recently used 2.2.2.2 must be evicted")
+	}
+
+	if !c.Contains(net.IPv4(1, 1, 1, 1)) || !c.Contains(net.IPv4(3, 3, 3, 3)) {
+		t.Errorf("1.1.1.1 and 3.3.3.3 must stay in cache")
+	}
+}
+
+func Test_ipCache_Restore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botassasin_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "whitelist.txt")
+
+	cfg := ipCacheConfig{path: path, ttl: time.Hour}
+
+	c := newIPCache(cfg)
+	c.AddSource(net.IPv4(1, 1, 1, 1), "geoip")
+	c.addWithTime("2.2.2.2", time.Now().Add(-time.Hour*2), "list")
+
+	buf := bytes.NewBuffer([]byte{})
+
+	_, err = c.writeTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// old format without source
+	buf.WriteString("3.3.3.3 " + time.Now().Format(cacheWriteTimeFormat) + "\n")
+
+	err = ioutil.WriteFile(path, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := newIPCaheFromFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.Len() != 2 {
+		t.Errorf("restored %d records, want 2", restored.Len())
+	}
+
+	if source, _ := restored.Lookup(net.IPv4(1, 1, 1, 1)); source != "geoip" {
+		t.Errorf("ipCache.Lookup() source = %q, want geoip", source)
+	}
+
+	if restored.Contains(net.IPv4(2, 2, 2, 2)) {
+		t.Errorf("expired 2.2.2.2 must not be restored")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+// listCacheMeta validators of cached list for conditional GET
+type listCacheMeta struct {
+	Src          string    `json:"src"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// listCache on-disk copy of remote list, list is downloaded again only
+// if it changed and cached copy is used if remote is unavailable
+type listCache struct {
+	dataPath string
+	metaPath string
+	// zero means cached copy is valid forever
+	maxStaleness time.Duration
+}
+
+func newListCache(dir string, src string, maxStaleness time.Duration) *listCache {
+	sum := sha256.Sum256([]byte(src))
+	name := "list-" + hex.EncodeToString(sum[:8])
+
+	return &listCache{
+		dataPath:     filepath.Join(dir, name+".data"),
+		metaPath:     filepath.Join(dir, name+".json"),
+		maxStaleness: maxStaleness,
+	}
+}
+
+// fetch download list with conditional GET, return data and time it was
+// last received from remote
+func (c *listCache) fetch(src string) ([]byte, time.Time, error) {
+	meta, cachedData, cacheErr := c.load()
+	if cacheErr != nil && !errors.Is(cacheErr, os.ErrNotExist) {
+		log.Printf("cannot read cached list %q: %v", src, cacheErr)
+	}
+
+	cached := cacheErr == nil
+
+	data, fresh, notModified, err := c.get(src, meta, cached)
+	if err == nil {
+		if notModified {
+			data = cachedData
+			fresh = meta
+			fresh.FetchedAt = time.Now()
+		}
+
+		fresh.Src = src
+
+		saveErr := c.save(fresh, data, !notModified)
+		if saveErr != nil {
+			log.Printf("cannot save list cache %q: %v", src, saveErr)
+		}
+
+		return data, fresh.FetchedAt, nil
+	}
+
+	if !cached {
+		return nil, time.Time{}, err
+	}
+
+	if c.stale(meta.FetchedAt, time.Now()) {
+		return nil, time.Time{}, fmt.Errorf("%w, cached copy fetched at %s is stale", err, meta.FetchedAt.Format(time.RFC3339))
+	}
+
+	log.Printf("%v, cached copy fetched at %s is used", err, meta.FetchedAt.Format(time.RFC3339))
+
+	return cachedData, meta.FetchedAt, nil
+}
+
+// get perform GET query, validators of cached copy are sent if it exists
+func (c *listCache) get(src string, meta listCacheMeta, cached bool) (data []byte, fresh listCacheMeta, notModified bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, src, nil)
+	if err != nil {
+		return nil, fresh, false, fmt.Errorf("cannot create query to %q: %w", src, err)
+	}
+
+	if cached {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	client := http.Client{
+		Timeout: httpRequestTimeout,
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fresh, false, fmt.Errorf("cannot perform GET query to %q: %w", src, err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified && cached {
+		return nil, fresh, true, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fresh, false, fmt.Errorf("GET query to %q response status %s", src, res.Status)
+	}
+
+	data, err = ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fresh, false, fmt.Errorf("cannot read from %q: %w", src, err)
+	}
+
+	fresh = listCacheMeta{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		FetchedAt:    time.Now(),
+	}
+
+	return data, fresh, false, nil
+}
+
+// stale cached copy older than max staleness cannot be used
+func (c *listCache) stale(fetchedAt time.Time, now time.Time) bool {
+	return c.maxStaleness > 0 && now.Sub(fetchedAt) > c.maxStaleness
+}
+
+func (c *listCache) load() (listCacheMeta, []byte, error) {
+	var meta listCacheMeta
+
+	metaData, err := ioutil.ReadFile(c.metaPath)
+	if err != nil {
+		return meta, nil, err
+	}
+
+	err = json.Unmarshal(metaData, &meta)
+	if err != nil {
+		return meta, nil, fmt.Errorf("cannot parse %s: %w", c.metaPath, err)
+	}
+
+	data, err := ioutil.ReadFile(c.dataPath)
+	if err != nil {
+		return meta, nil, err
+	}
+
+	return meta, data, nil
+}
+
+// save write data first, so meta never describe missing data
+func (c *listCache) save(meta listCacheMeta, data []byte, withData bool) error {
+	if withData {
+		err := writeFileAtomic(c.dataPath, func(w io.Writer) error {
+			_, err := io.Copy(w, bytes.NewReader(data))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("cannot marshal list cache meta: %w", err)
+	}
+
+	return writeFileAtomic(c.metaPath, func(w io.Writer) error {
+		_, err := w.Write(metaData)
+		return err
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listServer serve list with ETag and Last-Modified validators
+type listServer struct {
+	mu           sync.Mutex
+	content      string
+	etag         string
+	lastModified time.Time
+	down         bool
+
+	notModified int
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if s.etag != "" && r.Header.Get("If-None-Match") == s.etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !s.lastModified.IsZero() && !s.lastModified.After(since) {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if s.etag != "" {
+		w.Header().Set("ETag", s.etag)
+	}
+
+	if !s.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", s.lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	w.Write([]byte(s.content))
+}
+
+func (s *listServer) set(fn func(s *listServer)) {
+	s.mu.Lock()
+	fn(s)
+	s.mu.Unlock()
+}
+
+func Test_listCache_fetch(t *testing.T) {
+	tests := []struct {
+		name   string
+		server *listServer
+	}{
+		{
+			name:   "etag",
+			server: &listServer{content: "1.1.1.1\n", etag: `"v1"`},
+		},
+		{
+			name:   "last modified",
+			server: &listServer{content: "1.1.1.1\n", lastModified: time.Now().Add(-time.Hour).Truncate(time.Second)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.server)
+			defer srv.Close()
+
+			cache := newListCache(t.TempDir(), srv.URL, time.Hour)
+
+			data, _, err := cache.fetch(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != "1.1.1.1\n" {
+				t.Fatalf("fetch() = %q", data)
+			}
+
+			// not changed list is taken from cache
+			data, fetchedAt, err := cache.fetch(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != "1.1.1.1\n" || tt.server.notModified != 1 {
+				t.Fatalf("fetch() = %q, not modified responses %d, want 1", data, tt.server.notModified)
+			}
+
+			if time.Since(fetchedAt) > time.Minute {
+				t.Fatalf("fetch() time = %v, want now", fetchedAt)
+			}
+
+			// remote is unavailable
+			tt.server.set(func(s *listServer) { s.down = true })
+
+			data, _, err = cache.fetch(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != "1.1.1.1\n" {
+				t.Fatalf("fetch() from cache = %q", data)
+			}
+
+			// changed list is downloaded again
+			tt.server.set(func(s *listServer) {
+				s.down = false
+				s.content = "2.2.2.2\n"
+				s.etag = `"v2"`
+				s.lastModified = time.Now().Add(time.Hour)
+			})
+
+			data, _, err = cache.fetch(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(data) != "2.2.2.2\n" {
+				t.Fatalf("fetch() of changed list = %q", data)
+			}
+		})
+	}
+}
+
+func Test_listCache_stale(t *testing.T) {
+	server := &listServer{content: "1.1.1.1\n"}
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	cache := newListCache(t.TempDir(), srv.URL, time.Millisecond)
+
+	_, _, err := cache.fetch(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.set(func(s *listServer) { s.down = true })
+
+	time.Sleep(time.Millisecond * 5)
+
+	_, _, err = cache.fetch(srv.URL)
+	if err == nil {
+		t.Fatal("fetch() expected error for stale cache")
+	}
+}
+
+func Test_listChecker_cacheFallback(t *testing.T) {
+	server := &listServer{content: "1.1.1.1\n", etag: `"v1"`}
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+
+	cfg := listCheckerConfig{
+		Sources: []listCheckerSrcConfig{
+			{
+				Src:    srv.URL,
+				Type:   listCheckerSrcTypeTxt,
+				Action: "block",
+			},
+		},
+		CacheDir: t.TempDir(),
+	}
+
+	checker, err := newListChecker(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checker.Close()
+
+	// network is down on start
+	server.set(func(s *listServer) { s.down = true })
+
+	checker, err = newListChecker(cfg)
+	if err != nil {
+		t.Fatalf("newListChecker() with cached list error = %v", err)
+	}
+
+	defer checker.Close()
+
+	_, decision := checker.Check(&logLine{ip: net.ParseIP("1.1.1.1")})
+	if decision != decisionBan {
+		t.Fatalf("Check() = %v, want %v", decision, decisionBan)
+	}
+
+	cfg.CacheDir = t.TempDir()
+
+	_, err = newListChecker(cfg)
+	if err == nil {
+		t.Fatal("newListChecker() without cached list expected error")
+	}
+}
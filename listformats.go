@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	listCheckerSrcTypeGoogleIPRanges   = "google_ip_ranges"
+	listCheckerSrcTypeAzureServiceTags = "azure_service_tags"
+	listCheckerSrcTypeCloudflareIPs    = "cloudflare_ips"
+	listCheckerSrcTypeFastlyIPList     = "fastly_ip_list"
+	listCheckerSrcTypeFireHOLNetset    = "firehol_netset"
+	listCheckerSrcTypeSpamhausDrop     = "spamhaus_drop"
+	listCheckerSrcTypeCSV              = "csv"
+)
+
+// listParser parse list data to prefixes, filters are taken from source config
+type listParser func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error)
+
+var listParsers = map[string]listParser{
+	listCheckerSrcTypeTxt: func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+		return parseTxt(data), nil
+	},
+	listCheckerSrcTypeAWSIpRanges: func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+		var serviceFilter []string
+		serviceFilter = append(serviceFilter, cfg.AwsServiceFilter...)
+		serviceFilter = append(serviceFilter, cfg.ServiceFilter...)
+
+		return parseAWSIpRanges(data, serviceFilter, cfg.RegionFilter)
+	},
+	listCheckerSrcTypeGoogleIPRanges: func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+		return parseGoogleIPRanges(data, cfg.ServiceFilter, cfg.RegionFilter)
+	},
+	listCheckerSrcTypeAzureServiceTags: func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+		return parseAzureServiceTags(data, cfg.ServiceFilter, cfg.RegionFilter)
+	},
+	listCheckerSrcTypeCloudflareIPs: func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+		return parseCloudflareIPs(data)
+	},
+	listCheckerSrcTypeFastlyIPList: func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+		return parseFastlyIPList(data)
+	},
+	// netset is text list with # comments
+	listCheckerSrcTypeFireHOLNetset: func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+		return parseTxt(data), nil
+	},
+	listCheckerSrcTypeSpamhausDrop: func(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+		return parseSpamhausDrop(data), nil
+	},
+	listCheckerSrcTypeCSV: parseCSV,
+}
+
+// listFilterTypes formats with services and regions
+var listFilterTypes = map[string]bool{
+	listCheckerSrcTypeAWSIpRanges:      true,
+	listCheckerSrcTypeGoogleIPRanges:   true,
+	listCheckerSrcTypeAzureServiceTags: true,
+	listCheckerSrcTypeCSV:              true,
+}
+
+// validateListSource check that filters and csv options can be applied to
+// format of source
+func validateListSource(cfg listCheckerSrcConfig) error {
+	if len(cfg.AwsServiceFilter) > 0 && cfg.Type != listCheckerSrcTypeAWSIpRanges {
+		return fmt.Errorf("aws_service_filter is not supported by %s list", cfg.Type)
+	}
+
+	if (len(cfg.ServiceFilter) > 0 || len(cfg.RegionFilter) > 0) && !listFilterTypes[cfg.Type] {
+		return fmt.Errorf("service_filter and region_filter are not supported by %s list", cfg.Type)
+	}
+
+	switch cfg.Type {
+	case listCheckerSrcTypeAWSIpRanges:
+		// whole AWS is never matched by mistake
+		if len(cfg.AwsServiceFilter) == 0 && len(cfg.ServiceFilter) == 0 {
+			return fmt.Errorf("service_filter is required by %s list", cfg.Type)
+		}
+
+	case listCheckerSrcTypeCSV:
+		if cfg.CSVColumn == "" {
+			return fmt.Errorf("csv_column is required")
+		}
+
+		if len(cfg.ServiceFilter) > 0 && cfg.CSVServiceColumn == "" {
+			return fmt.Errorf("service_filter of csv requires csv_service_column")
+		}
+
+		if len(cfg.RegionFilter) > 0 && cfg.CSVRegionColumn == "" {
+			return fmt.Errorf("region_filter of csv requires csv_region_column")
+		}
+
+		if cfg.CSVSeparator != "" && utf8.RuneCountInString(cfg.CSVSeparator) != 1 {
+			return fmt.Errorf("csv_separator %q must be single character", cfg.CSVSeparator)
+		}
+	}
+
+	return nil
+}
+
+func listSrcTypes() []string {
+	types := make([]string, 0, len(listParsers))
+	for t := range listParsers {
+		types = append(types, t)
+	}
+
+	sort.Strings(types)
+
+	return types
+}
+
+// matchFilter empty filter match everything, aws_ip_ranges is exception:
+// service filter is required and empty one match nothing
+func matchFilter(value string, filter []string) bool {
+	return len(filter) == 0 || strInSlice(value, filter)
+}
+
+// parsePrefixes parse strings and skip invalid with log message
+func parsePrefixes(strs []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+
+	for _, str := range strs {
+		prefix, err := parseIPorCIDR(str)
+		if err != nil {
+			log.Printf("cannot parse %q: %v", str, err)
+			continue
+		}
+
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes
+}
+
+// parseGoogleIPRanges parse IP ranges in format used by Google Cloud,
+// Googlebot, Bing and Apple, service and scope are present only in Google Cloud
+func parseGoogleIPRanges(data []byte, serviceFilter []string, regionFilter []string) ([]netip.Prefix, error) {
+	var ranges struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+
+	err := json.Unmarshal(data, &ranges)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal google ip ranges: %w", err)
+	}
+
+	var strs []string
+
+	for _, r := range ranges.Prefixes {
+		if !matchFilter(r.Service, serviceFilter) || !matchFilter(r.Scope, regionFilter) {
+			continue
+		}
+
+		for _, str := range []string{r.IPv4Prefix, r.IPv6Prefix} {
+			if str != "" {
+				strs = append(strs, str)
+			}
+		}
+	}
+
+	return parsePrefixes(strs), nil
+}
+
+// parseAzureServiceTags service filter match name of tag (ex. AzureFrontDoor.Backend)
+// or system service (ex. AzureFrontDoor)
+func parseAzureServiceTags(data []byte, serviceFilter []string, regionFilter []string) ([]netip.Prefix, error) {
+	var tags struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				Region          string   `json:"region"`
+				SystemService   string   `json:"systemService"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+
+	err := json.Unmarshal(data, &tags)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal azure service tags: %w", err)
+	}
+
+	var strs []string
+
+	for _, tag := range tags.Values {
+		if len(serviceFilter) > 0 && !strInSlice(tag.Name, serviceFilter) && !strInSlice(tag.Properties.SystemService, serviceFilter) {
+			continue
+		}
+
+		if !matchFilter(tag.Properties.Region, regionFilter) {
+			continue
+		}
+
+		strs = append(strs, tag.Properties.AddressPrefixes...)
+	}
+
+	return parsePrefixes(strs), nil
+}
+
+// parseCloudflareIPs parse response of https://api.cloudflare.com/client/v4/ips,
+// text lists https://www.cloudflare.com/ips-v4 are parsed as txt
+func parseCloudflareIPs(data []byte) ([]netip.Prefix, error) {
+	var ips struct {
+		Result struct {
+			IPv4CIDRs []string `json:"ipv4_cidrs"`
+			IPv6CIDRs []string `json:"ipv6_cidrs"`
+		} `json:"result"`
+	}
+
+	err := json.Unmarshal(data, &ips)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal cloudflare ips: %w", err)
+	}
+
+	return parsePrefixes(append(ips.Result.IPv4CIDRs, ips.Result.IPv6CIDRs...)), nil
+}
+
+// parseFastlyIPList parse response of https://api.fastly.com/public-ip-list
+func parseFastlyIPList(data []byte) ([]netip.Prefix, error) {
+	var ips struct {
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+	}
+
+	err := json.Unmarshal(data, &ips)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal fastly ip list: %w", err)
+	}
+
+	return parsePrefixes(append(ips.Addresses, ips.IPv6Addresses...)), nil
+}
+
+// parseSpamhausDrop parse DROP and EDROP lists in text format
+// ("1.10.16.0/20 ; SBL256894") and in JSON lines format ({"cidr":"1.10.16.0/20",...})
+func parseSpamhausDrop(data []byte) []netip.Prefix {
+	scanner := bufio.NewScanner(bytes.NewBuffer(data))
+
+	var strs []string
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "{") {
+			var rec struct {
+				CIDR string `json:"cidr"`
+			}
+
+			err := json.Unmarshal([]byte(line), &rec)
+			if err != nil {
+				log.Printf("cannot parse %q: %v", line, err)
+				continue
+			}
+
+			// last line is metadata without cidr
+			if rec.CIDR != "" {
+				strs = append(strs, rec.CIDR)
+			}
+
+			continue
+		}
+
+		// remove comments
+		str := strings.TrimSpace(strings.Split(line, ";")[0])
+		if str != "" {
+			strs = append(strs, str)
+		}
+	}
+
+	return parsePrefixes(strs)
+}
+
+// parseCSV columns are set by header name or by number starting from 0,
+// if any column is set by name first row is header
+func parseCSV(data []byte, cfg listCheckerSrcConfig) ([]netip.Prefix, error) {
+	if cfg.CSVColumn == "" {
+		return nil, fmt.Errorf("csv_column is required")
+	}
+
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+
+	if cfg.CSVSeparator != "" {
+		r.Comma = []rune(cfg.CSVSeparator)[0]
+	}
+
+	columns := []string{cfg.CSVColumn, cfg.CSVServiceColumn, cfg.CSVRegionColumn}
+	indexes := make([]int, len(columns))
+	header := false
+
+	for i, col := range columns {
+		indexes[i] = -1
+
+		if col == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(col)
+		if err != nil {
+			header = true
+			continue
+		}
+
+		indexes[i] = n
+	}
+
+	if header {
+		names, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read csv header: %w", err)
+		}
+
+		for i, col := range columns {
+			if col == "" || indexes[i] >= 0 {
+				continue
+			}
+
+			for n, name := range names {
+				if strings.TrimSpace(name) == col {
+					indexes[i] = n
+					break
+				}
+			}
+
+			if indexes[i] < 0 {
+				return nil, fmt.Errorf("column %q is not found in csv header", col)
+			}
+		}
+	}
+
+	field := func(rec []string, idx int) string {
+		if idx < 0 || idx >= len(rec) {
+			return ""
+		}
+
+		return strings.TrimSpace(rec[idx])
+	}
+
+	var strs []string
+
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("cannot read csv: %w", err)
+		}
+
+		if indexes[1] >= 0 && !matchFilter(field(rec, indexes[1]), cfg.ServiceFilter) {
+			continue
+		}
+
+		if indexes[2] >= 0 && !matchFilter(field(rec, indexes[2]), cfg.RegionFilter) {
+			continue
+		}
+
+		if str := field(rec, indexes[0]); str != "" {
+			strs = append(strs, str)
+		}
+	}
+
+	return parsePrefixes(strs), nil
+}
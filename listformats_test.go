@@ -0,0 +1,326 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const (
+	testGoogleCloudRanges = `{
+  "syncToken": "1624792453",
+  "prefixes": [
+    {"ipv4Prefix": "34.1.208.0/20", "service": "Google Cloud", "scope": "africa-south1"},
+    {"ipv6Prefix": "2600:1900:8000::/44", "service": "Google Cloud", "scope": "us-central1"},
+    {"ipv4Prefix": "34.35.0.0/16", "service": "Google Cloud", "scope": "us-central1"}
+  ]
+}`
+
+	testAzureServiceTags = `{
+  "changeNumber": 1,
+  "cloud": "Public",
+  "values": [
+    {
+      "name": "AzureFrontDoor.Backend",
+      "id": "AzureFrontDoor.Backend",
+      "properties": {
+        "region": "",
+        "systemService": "AzureFrontDoor",
+        "addressPrefixes": ["13.73.248.16/29", "2603:1000:4::5e0/123"]
+      }
+    },
+    {
+      "name": "AzureMonitor.WestEurope",
+      "id": "AzureMonitor.WestEurope",
+      "properties": {
+        "region": "westeurope",
+        "systemService": "AzureMonitor",
+        "addressPrefixes": ["13.69.65.16/28"]
+      }
+    }
+  ]
+}`
+
+	testCloudflareIPs = `{
+  "result": {
+    "ipv4_cidrs": ["173.245.48.0/20"],
+    "ipv6_cidrs": ["2400:cb00::/32"],
+    "etag": "38f79d050aa027e3be3865e495dcc9bc"
+  },
+  "success": true,
+  "errors": [],
+  "messages": []
+}`
+
+	testFastlyIPList = `{"addresses":["23.235.32.0/20"],"ipv6_addresses":["2a04:4e40::/32"]}`
+
+	testFireHOLNetset = `#
+# firehol_level1
+#
+# Maintainer      : FireHOL
+#
+0.0.0.0/8
+1.10.16.0/20
+5.134.128.0/19
+`
+
+	testSpamhausDrop = `; Spamhaus DROP List 2021/06/24 - (c) 2021 The Spamhaus Project
+; Last-Modified: Thu, 24 Jun 2021 10:02:31 GMT
+1.10.16.0/20 ; SBL256894
+1.19.0.0/16 ; SBL434604
+`
+
+	testSpamhausDropJSON = `{"cidr":"1.10.16.0/20","sblid":"SBL256894","rir":"apnic"}
+{"cidr":"2001:678:738::/48","sblid":"SBL635837","rir":"ripencc"}
+{"type":"metadata","timestamp":1721289600,"size":2,"records":2,"copyright":"(c) 2024 The Spamhaus Project SLU","terms":"https://www.spamhaus.org/drop/terms/"}
+`
+
+	testAWSIpRanges = `{
+  "prefixes": [
+    {"ip_prefix": "15.177.0.0/18", "region": "GLOBAL", "service": "ROUTE53_HEALTHCHECKS"},
+    {"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "EC2"},
+    {"ip_prefix": "3.2.34.0/26", "region": "af-south-1", "service": "EC2"}
+  ],
+  "ipv6_prefixes": [
+    {"ipv6_prefix": "2600:1f14::/35", "region": "us-west-2", "service": "EC2"}
+  ]
+}`
+
+	testCSV = `# monitoring nodes
+network,service,region
+1.1.1.0/24,pingdom,eu
+2.2.2.2,pingdom,us
+3.3.3.0/24,uptimerobot,eu
+2001:db8::/32,uptimerobot,us
+`
+)
+
+func Test_listParsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		cfg     listCheckerSrcConfig
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "google cloud",
+			data: testGoogleCloudRanges,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeGoogleIPRanges},
+			want: []string{"34.1.208.0/20", "2600:1900:8000::/44", "34.35.0.0/16"},
+		},
+		{
+			name: "google cloud region filter",
+			data: testGoogleCloudRanges,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeGoogleIPRanges, ServiceFilter: []string{"Google Cloud"}, RegionFilter: []string{"us-central1"}},
+			want: []string{"2600:1900:8000::/44", "34.35.0.0/16"},
+		},
+		{
+			name: "googlebot",
+			data: testBotIPRanges,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeGoogleIPRanges},
+			want: []string{"10.0.0.0/8", "2001:db8::/32"},
+		},
+		{
+			name: "azure",
+			data: testAzureServiceTags,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeAzureServiceTags},
+			want: []string{"13.73.248.16/29", "2603:1000:4::5e0/123", "13.69.65.16/28"},
+		},
+		{
+			name: "azure system service filter",
+			data: testAzureServiceTags,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeAzureServiceTags, ServiceFilter: []string{"AzureFrontDoor"}},
+			want: []string{"13.73.248.16/29", "2603:1000:4::5e0/123"},
+		},
+		{
+			name: "azure tag name and region filter",
+			data: testAzureServiceTags,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeAzureServiceTags, ServiceFilter: []string{"AzureMonitor.WestEurope", "AzureFrontDoor.Backend"}, RegionFilter: []string{"westeurope"}},
+			want: []string{"13.69.65.16/28"},
+		},
+		{
+			name: "aws service and region filter",
+			data: testAWSIpRanges,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeAWSIpRanges, ServiceFilter: []string{"EC2"}, RegionFilter: []string{"ap-northeast-2", "us-west-2"}},
+			want: []string{"3.5.140.0/22", "2600:1f14::/35"},
+		},
+		{
+			name: "aws without service filter",
+			data: testAWSIpRanges,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeAWSIpRanges},
+			want: nil,
+		},
+		{
+			name: "cloudflare",
+			data: testCloudflareIPs,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeCloudflareIPs},
+			want: []string{"173.245.48.0/20", "2400:cb00::/32"},
+		},
+		{
+			name: "fastly",
+			data: testFastlyIPList,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeFastlyIPList},
+			want: []string{"23.235.32.0/20", "2a04:4e40::/32"},
+		},
+		{
+			name: "firehol netset",
+			data: testFireHOLNetset,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeFireHOLNetset},
+			want: []string{"0.0.0.0/8", "1.10.16.0/20", "5.134.128.0/19"},
+		},
+		{
+			name: "spamhaus drop",
+			data: testSpamhausDrop,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeSpamhausDrop},
+			want: []string{"1.10.16.0/20", "1.19.0.0/16"},
+		},
+		{
+			name: "spamhaus drop json",
+			data: testSpamhausDropJSON,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeSpamhausDrop},
+			want: []string{"1.10.16.0/20", "2001:678:738::/48"},
+		},
+		{
+			name: "csv column by name",
+			data: testCSV,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeCSV, CSVColumn: "network"},
+			want: []string{"1.1.1.0/24", "2.2.2.2/32", "3.3.3.0/24", "2001:db8::/32"},
+		},
+		{
+			name: "csv filters",
+			data: testCSV,
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeCSV, CSVColumn: "network", CSVServiceColumn: "service", CSVRegionColumn: "region", ServiceFilter: []string{"pingdom"}, RegionFilter: []string{"eu"}},
+			want: []string{"1.1.1.0/24"},
+		},
+		{
+			name: "csv column by number without header",
+			data: "a;1.1.1.1\nb;2.2.2.2\n",
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeCSV, CSVColumn: "1", CSVSeparator: ";"},
+			want: []string{"1.1.1.1/32", "2.2.2.2/32"},
+		},
+		{
+			name:    "csv unknown column",
+			data:    testCSV,
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeCSV, CSVColumn: "ip"},
+			wantErr: true,
+		},
+		{
+			name:    "csv without column",
+			data:    testCSV,
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeCSV},
+			wantErr: true,
+		},
+		{
+			name:    "broken json",
+			data:    "{",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeCloudflareIPs},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefixes, err := listParsers[tt.cfg.Type]([]byte(tt.data), tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			var got []string
+			for _, prefix := range prefixes {
+				got = append(got, prefix.String())
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateListSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     listCheckerSrcConfig
+		wantErr bool
+	}{
+		{
+			name: "google filters",
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeGoogleIPRanges, ServiceFilter: []string{"Google Cloud"}, RegionFilter: []string{"us-central1"}},
+		},
+		{
+			name: "aws service filter",
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeAWSIpRanges, AwsServiceFilter: []string{"EC2"}},
+		},
+		{
+			name:    "aws without service filter",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeAWSIpRanges, RegionFilter: []string{"us-west-2"}},
+			wantErr: true,
+		},
+		{
+			name:    "aws filter of other format",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeGoogleIPRanges, AwsServiceFilter: []string{"EC2"}},
+			wantErr: true,
+		},
+		{
+			name:    "txt service filter",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeTxt, ServiceFilter: []string{"EC2"}},
+			wantErr: true,
+		},
+		{
+			name:    "firehol region filter",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeFireHOLNetset, RegionFilter: []string{"eu"}},
+			wantErr: true,
+		},
+		{
+			name:    "spamhaus service filter",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeSpamhausDrop, ServiceFilter: []string{"drop"}},
+			wantErr: true,
+		},
+		{
+			name:    "cloudflare region filter",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeCloudflareIPs, RegionFilter: []string{"eu"}},
+			wantErr: true,
+		},
+		{
+			name:    "fastly service filter",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeFastlyIPList, ServiceFilter: []string{"cdn"}},
+			wantErr: true,
+		},
+		{
+			name: "csv filters with columns",
+			cfg:  listCheckerSrcConfig{Type: listCheckerSrcTypeCSV, CSVColumn: "network", CSVServiceColumn: "service", CSVRegionColumn: "region", ServiceFilter: []string{"pingdom"}, RegionFilter: []string{"eu"}, CSVSeparator: ";"},
+		},
+		{
+			name:    "csv service filter without column",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeCSV, CSVColumn: "network", ServiceFilter: []string{"pingdom"}},
+			wantErr: true,
+		},
+		{
+			name:    "csv region filter without column",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeCSV, CSVColumn: "network", CSVServiceColumn: "service", RegionFilter: []string{"eu"}},
+			wantErr: true,
+		},
+		{
+			name:    "csv multi-character separator",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeCSV, CSVColumn: "network", CSVSeparator: ";;"},
+			wantErr: true,
+		},
+		{
+			name:    "csv without column",
+			cfg:     listCheckerSrcConfig{Type: listCheckerSrcTypeCSV},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateListSource(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateListSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,15 +2,36 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/vasyahuyasa/botassasin/log"
 )
 
+const (
+	sourceField = "source"
+	// time of write in seconds with fraction (nginx $msec), it is used to
+	// measure latency of line
+	writtenAtField = "msec"
+)
+
 type logLine struct {
 	ip     net.IP
+	source string
 	fields map[string]string
+
+	// when line was written to log, zero if format has no msec field
+	writtenAt time.Time
+
+	// set by chain, line sent to recheck by asynchronous checker is decided
+	// again from position of that checker
+	recheckFrom  checker
+	recheckScore harmScore
+	// line was held, checkers after recheckFrom have not seen it
+	recheckHeld bool
 }
 
 type logParser struct {
@@ -42,6 +63,11 @@ func (l *logLine) String() string {
 	return fmt.Sprintf("%s %v", l.ip.String(), l.fields)
 }
 
+// Source path of log or name of input line come from
+func (l *logLine) Source() string {
+	return l.source
+}
+
 func (l *logLine) Get(field string) (string, bool) {
 	str, ok := l.fields[field]
 	return str, ok
@@ -57,6 +83,18 @@ func (l *logLine) EachField(fn func(key, value string)) {
 	}
 }
 
+// Clone return copy of line which can be changed independently
+func (l *logLine) Clone() *logLine {
+	c := *l
+	c.fields = make(map[string]string, len(l.fields))
+
+	for k, v := range l.fields {
+		c.fields[k] = v
+	}
+
+	return &c
+}
+
 func (p *logParser) Parse(str string) *logLine {
 	matches := p.re.FindStringSubmatch(str)
 
@@ -79,12 +117,29 @@ func (p *logParser) Parse(str string) *logLine {
 			continue
 		}
 
+		if name == writtenAtField {
+			l.writtenAt = parseMsec(matches[i])
+		}
+
 		l.Set(name, matches[i])
 	}
 
 	return l
 }
 
+// parseMsec parse unix time in seconds with fraction, zero time is
+// returned for malformed value
+func parseMsec(str string) time.Time {
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f <= 0 {
+		return time.Time{}
+	}
+
+	sec, frac := math.Modf(f)
+
+	return time.Unix(int64(sec), int64(frac*float64(time.Second)))
+}
+
 func (p *logParser) makeMapping() {
 	mapping := map[string]int{}
 
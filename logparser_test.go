@@ -4,6 +4,7 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_logParser_Parse(t *testing.T) {
@@ -48,6 +49,20 @@ func Test_logParser_Parse(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "written at",
+			re:   `^(?P<ip>\S+) .* msec=(?P<msec>\S+)$`,
+			args: args{
+				str: `83.149.21.43 - - [24/Jun/2021:12:02:44 +0000] "GET / HTTP/2.0" 200 7465 "-" "Mozilla/5.0" rt=0.074 msec=1624536164.250`,
+			},
+			want: &logLine{
+				ip: net.ParseIP("83.149.21.43"),
+				fields: map[string]string{
+					"msec": "1624536164.250",
+				},
+				writtenAt: time.Unix(1624536164, int64(time.Millisecond*250)),
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -46,8 +46,10 @@ func newlogPrinterFromWriter(w io.Writer, tpl string) (*logPrinter, error) {
 
 func (lw *logPrinter) Println(l logLine) error {
 	params := logPrinterParams{
-		"ip":   l.ip.String(),
-		"time": time.Now().Format(timeForamt),
+		"ip":        l.ip.String(),
+		"time":      time.Now().Format(timeForamt),
+		sourceField: l.Source(),
+		cidrField:   hostCIDR(l.IP()),
 	}
 
 	l.EachField(func(key, value string) {
@@ -70,3 +72,13 @@ func (lw *logPrinter) write(params logPrinterParams) error {
 
 	return nil
 }
+
+// Close close blocklog file, stdout is left open
+func (lw *logPrinter) Close() error {
+	f, ok := lw.w.(*os.File)
+	if !ok || f == os.Stdout {
+		return nil
+	}
+
+	return f.Close()
+}
@@ -6,37 +6,80 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
 )
 
 const (
 	checkDelay = time.Millisecond * 300
 )
 
+type rotationCounter func()
+
 type logStreamer struct {
 	ctx    context.Context
+	cancel context.CancelFunc
+	// lines are not sent when shutdown timeout is over
+	drain  context.Context
+	path   string
 	f      *os.File
+	r      *bufio.Reader
 	err    error
 	pos    int64
 	parser *logParser
+
+	// beginning of line without line break at end of file
+	partial string
+
+	rotated    rotationCounter
+	checkpoint *logCheckpoint
+	notifier   fileNotifier
+
+	// reading is resumed from offset of checkpoint
+	resumed bool
 }
 
-func newLogStreamer(ctx context.Context, f *os.File, parser *logParser) (*logStreamer, error) {
+func newLogStreamer(ctx context.Context, path string, parser *logParser, rotated rotationCounter, checkpoint *logCheckpoint) (*logStreamer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open log %s: %w", path, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
 	r := &logStreamer{
-		ctx:    ctx,
-		f:      f,
-		parser: parser,
+		ctx:        ctx,
+		cancel:     cancel,
+		drain:      drainContext(ctx, shutdownTimeout),
+		path:       path,
+		f:          f,
+		r:          bufio.NewReader(f),
+		parser:     parser,
+		rotated:    rotated,
+		checkpoint: checkpoint,
+		notifier:   newFileNotifier(path),
 	}
 
 	stat, err := f.Stat()
 	if err != nil {
+		r.close()
 		return nil, fmt.Errorf("cannot stat log: %w", err)
 	}
 
 	r.pos = stat.Size()
 
+	offset, ok := checkpoint.Offset(path, stat, time.Now())
+	if ok {
+		log.Printf("resume %s from offset %d (%d bytes to catch up)", path, offset, r.pos-offset)
+		r.pos = offset
+		r.resumed = true
+	}
+
 	_, err = f.Seek(r.pos, io.SeekStart)
 	if err != nil {
+		r.close()
 		return nil, fmt.Errorf("cannot seek to %d: %w", r.pos, err)
 	}
 
@@ -46,30 +89,202 @@ func newLogStreamer(ctx context.Context, f *os.File, parser *logParser) (*logStr
 func (r *logStreamer) C() <-chan *logLine {
 	c := make(chan *logLine)
 
-	go func(logChan chan *logLine) {
-		defer func() {
-			close(logChan)
-		}()
+	go func() {
+		defer close(c)
 
-		for {
-			scanner := bufio.NewScanner(r.f)
-			for scanner.Scan() {
-				s := scanner.Text()
-				log := r.parser.Parse(s)
-				logChan <- log
-			}
+		r.stream(c)
+	}()
 
-			if scanErr := scanner.Err(); scanErr != nil {
-				r.err = fmt.Errorf("cannot scan line from log buffer: %w", scanErr)
-			}
+	return c
+}
+
+// stream send lines to logChan until context is cancelled, lines which
+// are not sent before shutdown timeout are read from checkpoint next time
+func (r *logStreamer) stream(logChan chan *logLine) {
+	defer r.close()
 
-			time.Sleep(checkDelay)
+	for {
+		err := r.readLines(logChan)
+		if err != nil {
+			r.err = err
+			return
 		}
-	}(c)
 
-	return c
+		if r.drain.Err() != nil {
+			r.saveOffset()
+			log.Printf("shutdown timeout, %s is left unprocessed from offset %d", r.path, r.pos-int64(len(r.partial)))
+
+			return
+		}
+
+		err = r.checkRotation(logChan)
+		if err != nil {
+			r.err = err
+			return
+		}
+
+		r.saveOffset()
+
+		r.notifier.Wait(r.ctx)
+
+		if r.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// stop stream of log which is not watched anymore
+func (r *logStreamer) stop() {
+	r.cancel()
+}
+
+// close release log and notifier, streamer which is not started is closed
+// directly
+func (r *logStreamer) close() {
+	r.cancel()
+	r.f.Close()
+	r.notifier.Close()
 }
 
 func (r *logStreamer) Err() error {
 	return r.err
 }
+
+// readLines send all complete lines to logChan, incomplete line at the end
+// of file is kept until rest of line is written
+func (r *logStreamer) readLines(logChan chan *logLine) error {
+	for {
+		str, err := r.r.ReadString('\n')
+		r.pos += int64(len(str))
+
+		if err == io.EOF {
+			r.partial += str
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("cannot read line from log: %w", err)
+		}
+
+		if !r.send(logChan, r.partial+str) {
+			// offset of checkpoint point to beginning of line
+			r.pos -= int64(len(str))
+			return nil
+		}
+
+		r.partial = ""
+	}
+}
+
+// send return false if line is not sent before shutdown timeout
+func (r *logStreamer) send(logChan chan *logLine, str string) bool {
+	str = strings.TrimRight(str, "\r\n")
+	if str == "" {
+		return true
+	}
+
+	l := r.parser.Parse(str)
+	l.source = r.path
+
+	// consumer read channel until it closed, so line is not lost if it is
+	// sent before shutdown timeout
+	select {
+	case logChan <- l:
+		return true
+	case <-r.drain.Done():
+		return false
+	}
+}
+
+// checkRotation reopen log when file is renamed (logrotate create mode) and
+// read it from start when file is truncated (logrotate copytruncate mode)
+func (r *logStreamer) checkRotation(logChan chan *logLine) error {
+	stat, err := os.Stat(r.path)
+	if err != nil {
+		// file is moved and new one is not created yet
+		log.Debugf("cannot stat %s: %v", r.path, err)
+		return nil
+	}
+
+	current, err := r.f.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat log: %w", err)
+	}
+
+	if !os.SameFile(current, stat) {
+		// drain lines written to old file before rotation
+		err = r.readLines(logChan)
+		if err != nil {
+			return err
+		}
+
+		if r.drain.Err() != nil {
+			return nil
+		}
+
+		if r.partial != "" && !r.send(logChan, r.partial) {
+			return nil
+		}
+
+		f, err := os.Open(r.path)
+		if err != nil {
+			return fmt.Errorf("cannot reopen log %s: %w", r.path, err)
+		}
+
+		r.f.Close()
+		r.f = f
+		r.reset()
+
+		log.Printf("log %s rotated, reopened", r.path)
+
+		return nil
+	}
+
+	if stat.Size() < r.pos {
+		_, err = r.f.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("cannot seek to start of log: %w", err)
+		}
+
+		r.reset()
+
+		log.Printf("log %s truncated, read from start", r.path)
+	}
+
+	return nil
+}
+
+// rewind read log from start
+func (r *logStreamer) rewind() error {
+	_, err := r.f.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("cannot seek to start of log: %w", err)
+	}
+
+	r.r.Reset(r.f)
+	r.pos = 0
+	r.partial = ""
+
+	return nil
+}
+
+// saveOffset remember offset of last complete line
+func (r *logStreamer) saveOffset() {
+	stat, err := r.f.Stat()
+	if err != nil {
+		log.Printf("cannot stat log: %v", err)
+		return
+	}
+
+	r.checkpoint.Update(r.path, fileInode(stat), r.pos-int64(len(r.partial)))
+}
+
+func (r *logStreamer) reset() {
+	r.r.Reset(r.f)
+	r.pos = 0
+	r.partial = ""
+
+	if r.rotated != nil {
+		r.rotated()
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const streamTestFormat = `^(?P<ip>\S+) (?P<request>.*)$`
+
+func Test_logStreamer_Rotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate func(t *testing.T, path string)
+	}{
+		{
+			name: "rename and create",
+			rotate: func(t *testing.T, path string) {
+				err := os.Rename(path, path+".1")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				appendLog(t, path+".1", "1.1.1.2 /before_rotation\n")
+				appendLog(t, path, "")
+			},
+		},
+		{
+			name: "copytruncate",
+			rotate: func(t *testing.T, path string) {
+				err := os.Truncate(path, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "botassasin_stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "access.log")
+			appendLog(t, path, "0.0.0.0 /skipped_before_start\n")
+
+			parser, err := newLogParser(streamTestFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rotations := 0
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			streamer, err := newLogStreamer(ctx, path, parser, func() { rotations++ }, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := streamer.C()
+
+			appendLog(t, path, "1.1.1.1 /first\n")
+			expectLine(t, c, "/first")
+
+			tt.rotate(t, path)
+
+			if tt.name == "rename and create" {
+				expectLine(t, c, "/before_rotation")
+			}
+
+			// wait until rotation detected
+			time.Sleep(checkDelay * 2)
+
+			appendLog(t, path, "2.2.2.2 /after_rotation\n")
+			expectLine(t, c, "/after_rotation")
+
+			if rotations != 1 {
+				t.Errorf("rotations = %d, want 1", rotations)
+			}
+		})
+	}
+}
+
+func appendLog(t *testing.T, path, str string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectLine(t *testing.T, c <-chan *logLine, request string) {
+	t.Helper()
+
+	select {
+	case l := <-c:
+		if got, _ := l.Get("request"); got != request {
+			t.Fatalf("got request %q, want %q", got, request)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timeout waiting for %q", request)
+	}
+}
+
+func Test_logStreamer_Checkpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxCatchup  time.Duration
+		savedAgo    time.Duration
+		wantRequest string
+	}{
+		{
+			name:        "resume from checkpoint",
+			maxCatchup:  time.Hour,
+			savedAgo:    time.Minute,
+			wantRequest: "/while_stopped",
+		},
+		{
+			name:        "checkpoint too old",
+			maxCatchup:  time.Hour,
+			savedAgo:    time.Hour * 2,
+			wantRequest: "/after_start",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "botassasin_stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "access.log")
+			appendLog(t, path, "0.0.0.0 /processed\n")
+
+			stat, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cp := newLogCheckpoint(filepath.Join(dir, "checkpoint"), tt.maxCatchup)
+			cp.data[path] = checkpointRecord{
+				inode:   fileInode(stat),
+				offset:  stat.Size(),
+				savedAt: time.Now().Add(-tt.savedAgo),
+			}
+
+			appendLog(t, path, "1.1.1.1 /while_stopped\n")
+
+			parser, err := newLogParser(streamTestFormat)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			streamer, err := newLogStreamer(ctx, path, parser, nil, cp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := streamer.C()
+
+			appendLog(t, path, "2.2.2.2 /after_start\n")
+			expectLine(t, c, tt.wantRequest)
+		})
+	}
+}
+
+func Test_logStreamer_C_shutdownTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	appendLog(t, path, "")
+
+	parser, err := newLogParser(streamTestFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp := newLogCheckpoint("", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	streamer, err := newLogStreamer(ctx, path, parser, nil, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	drain, drainCancel := context.WithCancel(context.Background())
+	streamer.drain = drain
+
+	c := streamer.C()
+
+	first := "1.1.1.1 /processed\n"
+	appendLog(t, path, first+"2.2.2.2 /unprocessed\n3.3.3.3 /unprocessed\n")
+	expectLine(t, c, "/processed")
+
+	// shutdown timeout is over while nobody read lines
+	cancel()
+	drainCancel()
+	time.Sleep(checkDelay)
+
+	done := make(chan struct{})
+	go func() {
+		for l := range c {
+			t.Errorf("line %q is sent after shutdown timeout", l.String())
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("streamer is blocked after shutdown timeout")
+	}
+
+	rec, ok := cp.data[path]
+	if !ok {
+		t.Fatal("offset is not saved on shutdown timeout")
+	}
+
+	if rec.offset != int64(len(first)) {
+		t.Errorf("got offset %d, want offset of first unprocessed line %d", rec.offset, len(first))
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const globRescanInterval = time.Second * 10
+
+type logWatcherSource struct {
+	// path or glob pattern
+	pattern string
+	parser  *logParser
+}
+
+// logWatcher stream lines from all files matched by sources into single
+// channel, files created after start are picked up automatically
+type logWatcher struct {
+	ctx        context.Context
+	sources    []logWatcherSource
+	rotated    rotationCounter
+	checkpoint *logCheckpoint
+
+	rescanInterval time.Duration
+
+	mu        *sync.Mutex
+	err       error
+	streamers map[string]*logStreamer
+	wg        *sync.WaitGroup
+}
+
+func newLogWatcher(ctx context.Context, sources []logWatcherSource, rotated rotationCounter, checkpoint *logCheckpoint) (*logWatcher, error) {
+	w := &logWatcher{
+		ctx:        ctx,
+		sources:    sources,
+		rotated:    rotated,
+		checkpoint: checkpoint,
+
+		rescanInterval: globRescanInterval,
+
+		mu:        &sync.Mutex{},
+		streamers: map[string]*logStreamer{},
+		wg:        &sync.WaitGroup{},
+	}
+
+	err := w.open()
+	if err != nil {
+		for _, streamer := range w.streamers {
+			streamer.close()
+		}
+
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// open start watching files matched at start, they are read from end
+func (w *logWatcher) open() error {
+	for _, src := range w.sources {
+		paths, err := filepath.Glob(src.pattern)
+		if err != nil {
+			return fmt.Errorf("bad pattern %q: %w", src.pattern, err)
+		}
+
+		if len(paths) == 0 {
+			if !isGlob(src.pattern) {
+				return fmt.Errorf("log %s not found", src.pattern)
+			}
+
+			log.Printf("no logs match %s yet", src.pattern)
+		}
+
+		for _, path := range paths {
+			if _, ok := w.streamers[path]; ok {
+				continue
+			}
+
+			streamer, err := newLogStreamer(w.ctx, path, src.parser, w.rotated, w.checkpoint)
+			if err != nil {
+				return err
+			}
+
+			w.streamers[path] = streamer
+		}
+	}
+
+	return nil
+}
+
+func (w *logWatcher) C() <-chan *logLine {
+	c := make(chan *logLine)
+
+	w.mu.Lock()
+	for _, streamer := range w.streamers {
+		w.forward(streamer, c)
+	}
+	w.mu.Unlock()
+
+	w.wg.Add(1)
+	go w.rescan(c)
+
+	go func() {
+		w.wg.Wait()
+		close(c)
+	}()
+
+	return c
+}
+
+func (w *logWatcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+func (w *logWatcher) forward(streamer *logStreamer, c chan *logLine) {
+	w.wg.Add(1)
+
+	go func() {
+		defer w.wg.Done()
+
+		// streamer send lines directly, so line is never taken from
+		// streamer and lost on shutdown timeout
+		streamer.stream(c)
+
+		err := streamer.Err()
+		if err == nil {
+			return
+		}
+
+		log.Printf("stop watching %s: %v", streamer.path, err)
+
+		// file can be picked up again by next rescan
+		w.mu.Lock()
+		if w.streamers[streamer.path] == streamer {
+			delete(w.streamers, streamer.path)
+		}
+		w.err = err
+		w.mu.Unlock()
+	}()
+}
+
+// rescan periodically look for new files matched by glob patterns and
+// stop watching of removed ones
+func (w *logWatcher) rescan(c chan *logLine) {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.rescanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		matched := map[string]bool{}
+		failed := false
+
+		for _, src := range w.sources {
+			paths, err := filepath.Glob(src.pattern)
+			if err != nil {
+				log.Printf("bad pattern %q: %v", src.pattern, err)
+				failed = true
+				continue
+			}
+
+			for _, path := range paths {
+				matched[path] = true
+
+				w.mu.Lock()
+				_, ok := w.streamers[path]
+				w.mu.Unlock()
+
+				if ok {
+					continue
+				}
+
+				streamer, err := newLogStreamer(w.ctx, path, src.parser, w.rotated, w.checkpoint)
+				if err != nil {
+					log.Printf("cannot watch %s: %v", path, err)
+					continue
+				}
+
+				// file is created after start, all lines are new if
+				// it was not read before
+				if !streamer.resumed {
+					err = streamer.rewind()
+					if err != nil {
+						streamer.close()
+						log.Printf("cannot watch %s: %v", path, err)
+						continue
+					}
+				}
+
+				log.Printf("watch new log %s", path)
+
+				w.mu.Lock()
+				w.streamers[path] = streamer
+				w.mu.Unlock()
+
+				w.forward(streamer, c)
+			}
+		}
+
+		if !failed {
+			w.dropVanished(matched)
+		}
+	}
+}
+
+// dropVanished stop watching of files which are not matched by glob
+// patterns anymore, files set without glob are waited to be created again
+func (w *logWatcher) dropVanished(matched map[string]bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for path, streamer := range w.streamers {
+		if matched[path] || w.isLiteral(path) {
+			continue
+		}
+
+		streamer.stop()
+		delete(w.streamers, path)
+
+		log.Printf("log %s removed, stop watching", path)
+	}
+}
+
+func (w *logWatcher) isLiteral(path string) bool {
+	for _, src := range w.sources {
+		if !isGlob(src.pattern) && src.pattern == path {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
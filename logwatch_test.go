@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_logWatcher_Glob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botassasin_watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.access.log")
+	appendLog(t, first, "")
+
+	parser, err := newLogParser(streamTestFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherParser, err := newLogParser(`^(?P<ip>\S+) \S+ (?P<request>.*)$`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := newLogWatcher(ctx, []logWatcherSource{
+		{pattern: filepath.Join(dir, "*.access.log"), parser: parser},
+		{pattern: filepath.Join(dir, "other.log"), parser: otherParser},
+	}, nil, nil)
+	if err == nil {
+		t.Fatal("not existing log without glob must be an error")
+	}
+
+	appendLog(t, filepath.Join(dir, "other.log"), "")
+
+	w, err = newLogWatcher(ctx, []logWatcherSource{
+		{pattern: filepath.Join(dir, "*.access.log"), parser: parser},
+		{pattern: filepath.Join(dir, "other.log"), parser: otherParser},
+	}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.rescanInterval = checkDelay
+
+	c := w.C()
+
+	appendLog(t, first, "1.1.1.1 /first\n")
+	l := expectSource(t, c, first)
+	if got, _ := l.Get("request"); got != "/first" {
+		t.Errorf("got request %q, want /first", got)
+	}
+
+	appendLog(t, filepath.Join(dir, "other.log"), "2.2.2.2 vhost /other\n")
+	l = expectSource(t, c, filepath.Join(dir, "other.log"))
+	if got, _ := l.Get("request"); got != "/other" {
+		t.Errorf("got request %q, want /other", got)
+	}
+
+	// new file must be read from start
+	second := filepath.Join(dir, "second.access.log")
+	appendLog(t, second, "3.3.3.3 /second\n")
+	expectSource(t, c, second)
+
+	// removed file is not watched anymore
+	err = os.Remove(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(checkDelay * 3)
+
+	w.mu.Lock()
+	_, watched := w.streamers[second]
+	w.mu.Unlock()
+
+	if watched {
+		t.Errorf("removed %s is still watched", second)
+	}
+
+	// wait until streamers are stopped
+	cancel()
+	for range c {
+	}
+}
+
+func Test_logWatcher_rescan_checkpoint(t *testing.T) {
+	dir := t.TempDir()
+
+	parser, err := newLogParser(streamTestFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cp := newLogCheckpoint("", 0)
+
+	w, err := newLogWatcher(ctx, []logWatcherSource{
+		{pattern: filepath.Join(dir, "*.access.log"), parser: parser},
+	}, nil, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.rescanInterval = checkDelay
+
+	// file was read before it is picked up by rescan
+	path := filepath.Join(dir, "first.access.log")
+	processed := "1.1.1.1 /processed\n"
+	appendLog(t, path, processed+"2.2.2.2 /unprocessed\n")
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cp.Update(path, fileInode(stat), int64(len(processed)))
+
+	c := w.C()
+
+	l := expectSource(t, c, path)
+	if got, _ := l.Get("request"); got != "/unprocessed" {
+		t.Errorf("got request %q, want /unprocessed", got)
+	}
+}
+
+func expectSource(t *testing.T, c <-chan *logLine, source string) *logLine {
+	t.Helper()
+
+	select {
+	case l := <-c:
+		if l.Source() != source {
+			t.Fatalf("got source %q, want %q", l.Source(), source)
+		}
+		return l
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timeout waiting for line from %q", source)
+	}
+
+	return nil
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -30,6 +33,62 @@ var (
 		Name:       "botassasin_block_action_duration_seconds",
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
 	})
+
+	duplicateBlocksCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "botassasin_duplicate_blocks_total",
+		Help: "Ban decisions for IPs and subnets already blocked, block action is not executed again",
+	})
+
+	logRotationsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "botassasin_log_rotations_total",
+	})
+
+	lineLatencySummary = promauto.NewSummary(prometheus.SummaryOpts{
+		Name:       "botassasin_line_latency_seconds",
+		Help:       "Time from write of line to log until botassasin made decision about it",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	})
+
+	rdnsCacheCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "botassasin_rdns_cache_total",
+		Help: "Reverse DNS verification cache hits and misses",
+	}, []string{"result"})
+
+	rdnsLookupSummary = promauto.NewSummary(prometheus.SummaryOpts{
+		Name:       "botassasin_rdns_lookup_duration_seconds",
+		Help:       "Time of reverse and forward DNS lookups of IP verification",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	})
+
+	rdnsQueueGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "botassasin_rdns_queue_depth",
+		Help: "Number of IPs waiting for asynchronous reverse DNS verification",
+	})
+
+	rdnsDroppedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "botassasin_rdns_queue_dropped_total",
+		Help: "IPs not queued for asynchronous reverse DNS verification because queue is full",
+	})
+
+	rechecksAbandonedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "botassasin_rechecks_abandoned_total",
+		Help: "Lines of asynchronous checkers which are not decided again because checker was replaced by reload or stopped",
+	})
+
+	mmdbBuildEpochGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "botassasin_mmdb_build_epoch_seconds",
+		Help: "Build time of loaded GeoIP or ASN database",
+	}, []string{"path"})
+
+	listRefreshGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "botassasin_list_last_refresh_timestamp_seconds",
+		Help: "Time of last successful load of list source",
+	}, []string{"source"})
+
+	listEntriesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "botassasin_list_entries",
+		Help: "Number of entries in list source",
+	}, []string{"source"})
 )
 
 func main() {
@@ -37,13 +96,6 @@ func main() {
 
 	log.EnableDebug(cfg.Debug)
 
-	parser, err := newLogParser(cfg.LogFormat)
-	if err != nil {
-		log.Fatalf("cannot create log parser: %v", err)
-	}
-
-	log.Println("log format:", cfg.LogFormat)
-
 	metricsAddr := defaultMetricsAddr
 	if cfg.MetricsAddr != "" {
 		metricsAddr = cfg.MetricsAddr
@@ -60,31 +112,53 @@ func main() {
 		checkerSummary.WithLabelValues(name).Observe(float64(seconds))
 	}
 
-	cn, err := newChainFromConfig(cfg, measureFn)
-	if err != nil {
-		log.Fatalf("cannot create chain: %v", err)
+	rotationCounter := func() {
+		logRotationsCounter.Inc()
 	}
 
-	streamfile, err := os.Open(cfg.Logfile)
+	checkpoint, err := newLogCheckpointFromFile(cfg.CheckpointPath, cfg.CheckpointMaxCatchup)
 	if err != nil {
-		log.Fatalf("cannot open log file %s: %v", cfg.Logfile, err)
+		log.Fatalf("cannot load checkpoint: %v", err)
 	}
 
-	logStream, err := newLogStreamer(context.Background(), streamfile, parser)
+	// stop reading of logs on signal, lines already read are processed
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go func() {
+		<-ctx.Done()
+		log.Printf("shutting down, send signal again to exit immediately")
+
+		// restore default behavior, so next signal kill process
+		stop()
+	}()
+
+	logStream, err := newLineSourceFromConfig(ctx, cfg, rotationCounter, checkpoint)
 	if err != nil {
-		log.Fatalf("cannot initialize log stre: %v", err)
+		log.Fatalf("cannot initialize log stream: %v", err)
 	}
 
-	act, err := newAction(cfg.BlockAction.params)
+	p, err := newPipelineFromConfig(cfg, measureFn, nil)
 	if err != nil {
-		log.Fatalf("cannot create action: %v", err)
+		log.Fatalf("%v", err)
 	}
 
 	log.Printf("block action: %s", cfg.BlockAction)
 
-	lp, err := newLogPrinter(cfg.Blocklog, cfg.BlocklogTemplate)
+	banForgetAfter := defaultBanForgetAfter
+	if cfg.BanForgetAfter != 0 {
+		banForgetAfter = cfg.BanForgetAfter
+	}
+
+	bans, err := newBanLedgerFromFile(cfg.BanLedgerPath, cfg.BanEscalation.Steps(cfg.BanDuration), banForgetAfter)
 	if err != nil {
-		log.Fatalf("cannot create log printer: %v", err)
+		log.Fatalf("cannot load ban ledger: %v", err)
+	}
+
+	if len(cfg.BanEscalation.steps) > 0 {
+		log.Printf("ban escalation [%s], unblock action: %s", cfg.BanEscalation, cfg.UnblockAction)
+	} else if cfg.BanDuration > 0 {
+		log.Printf("ban duration %s, unblock action: %s", cfg.BanDuration, cfg.UnblockAction)
 	}
 
 	hitCounter := func(name string) {
@@ -95,15 +169,51 @@ func main() {
 		blockSummary.Observe(seconds)
 	}
 
-	app := newAppCore(logStream, cn, act, lp, cfg.WhitelistCachePath, hitCounter, timeMeasurer)
+	latencyMeasurer := func(seconds float64) {
+		lineLatencySummary.Observe(seconds)
+	}
+
+	cacheCfg := ipCacheConfig{
+		path:    cfg.WhitelistCachePath,
+		ttl:     defaultWhitelistCacheTTL,
+		maxSize: defaultWhitelistCacheSize,
+	}
+
+	if cfg.WhitelistCacheTTL != 0 {
+		cacheCfg.ttl = cfg.WhitelistCacheTTL
+	}
+
+	if cfg.WhitelistCacheSize != 0 {
+		cacheCfg.maxSize = cfg.WhitelistCacheSize
+	}
+
+	app := newAppCore(logStream, p, cacheCfg, bans, hitCounter, timeMeasurer, latencyMeasurer)
+
+	reloader := newConfigReloader(configFile, cfg, app, measureFn)
+	http.Handle(reloadPath, reloader)
+	go reloader.watchSignal(ctx)
 
-	log.Printf("watch %s", cfg.Logfile)
+	log.Printf("read log from %s", cfg.Logfile)
+
+	checkpointStop := make(chan struct{})
+	go checkpoint.saver(checkpointStop)
 
 	err = app.run()
 
+	close(checkpointStop)
+
+	checkpointErr := checkpoint.Save()
+	if checkpointErr != nil {
+		checkpointErr = fmt.Errorf("cannot save checkpoint: %w", checkpointErr)
+	}
+
+	err = firstErr(err, checkpointErr)
 	if err != nil {
-		log.Printf("log streamer exit with error: %v", err)
+		log.Printf("exit with error: %v", err)
+		os.Exit(1)
 	}
+
+	log.Printf("stopped")
 }
 
 func setUpMetricServer(addr string) error {
@@ -112,14 +222,7 @@ func setUpMetricServer(addr string) error {
 }
 
 func readConfig() config {
-	f, err := os.Open(configFile)
-	if err != nil {
-		log.Fatalf("cannot open config file %s: %v", configFile, err)
-	}
-
-	defer f.Close()
-
-	cfg, err := loadConfig(f)
+	cfg, err := loadConfigFile(configFile)
 	if err != nil {
 		log.Fatalf("cannot load config: %v", err)
 	}
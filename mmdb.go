@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	defaultMMDBReloadInterval = time.Minute
+
+	embededMMDBName = "embeded"
+)
+
+// mmdbReader MaxMind database which is reopened when file is changed,
+// lookups continue while new file is loaded
+type mmdbReader struct {
+	path string
+
+	mu      *sync.RWMutex
+	db      *maxminddb.Reader
+	modTime time.Time
+
+	stop chan struct{}
+}
+
+func newMMDBReaderFromBytes(b []byte) (*mmdbReader, error) {
+	db, err := maxminddb.FromBytes(b)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mmdbReader{
+		path: embededMMDBName,
+		mu:   &sync.RWMutex{},
+		db:   db,
+		stop: make(chan struct{}),
+	}
+
+	r.reportBuildEpoch()
+
+	return r, nil
+}
+
+// newMMDBReader open database and check file for changes every interval,
+// zero interval disable reload
+func newMMDBReader(path string, interval time.Duration) (*mmdbReader, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &mmdbReader{
+		path:    path,
+		mu:      &sync.RWMutex{},
+		db:      db,
+		modTime: fi.ModTime(),
+		stop:    make(chan struct{}),
+	}
+
+	r.reportBuildEpoch()
+
+	if interval > 0 {
+		go r.watch(interval)
+	}
+
+	return r, nil
+}
+
+func (r *mmdbReader) Lookup(ip net.IP, result interface{}) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.db.Lookup(ip, result)
+}
+
+// reload open database again if file modification time is changed, on
+// error previous database is kept
+func (r *mmdbReader) reload() (bool, error) {
+	fi, err := os.Stat(r.path)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	changed := !fi.ModTime().Equal(r.modTime)
+	r.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	db, err := maxminddb.Open(r.path)
+	if err == nil {
+		err = db.Verify()
+		if err != nil {
+			db.Close()
+		}
+	}
+
+	r.mu.Lock()
+	// broken file is not loaded again until it is changed
+	r.modTime = fi.ModTime()
+
+	if err != nil {
+		r.mu.Unlock()
+		return false, err
+	}
+
+	// wait for in flight lookups to finish before old database is closed
+	old := r.db
+	r.db = db
+	r.mu.Unlock()
+
+	r.reportBuildEpoch()
+
+	return true, old.Close()
+}
+
+func (r *mmdbReader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := r.reload()
+		if err != nil {
+			log.Printf("cannot reload database %s, previous database is used: %v", r.path, err)
+			continue
+		}
+
+		if reloaded {
+			log.Printf("database %s reloaded, build time %s", r.path, r.BuildTime().Format(time.RFC3339))
+		}
+	}
+}
+
+// IsCity return true for GeoIP2-City and GeoLite2-City databases
+func (r *mmdbReader) IsCity() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return strings.Contains(r.db.Metadata.DatabaseType, "City")
+}
+
+func (r *mmdbReader) BuildTime() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return time.Unix(int64(r.db.Metadata.BuildEpoch), 0)
+}
+
+func (r *mmdbReader) reportBuildEpoch() {
+	mmdbBuildEpochGauge.WithLabelValues(r.path).Set(float64(r.BuildTime().Unix()))
+}
+
+func (r *mmdbReader) Close() error {
+	close(r.stop)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.db.Close()
+	if err != nil {
+		return fmt.Errorf("cannot close database %s: %w", r.path, err)
+	}
+
+	return nil
+}
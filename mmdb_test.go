@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_mmdbReader_reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.mmdb")
+
+	// every write has new modification time
+	modTime := time.Now()
+	copyDB := func(src string) {
+		b, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeDB(t, path, b, modTime)
+		modTime = modTime.Add(time.Second)
+	}
+
+	lookupCountry := func(r *mmdbReader) string {
+		var rec geoIPRecord
+
+		err := r.Lookup(net.IPv4(95, 173, 136, 72), &rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return rec.Country.ISOCode
+	}
+
+	copyDB("test-data/geoip2-country.mmdb")
+
+	r, err := newMMDBReader(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if reloaded, err := r.reload(); reloaded || err != nil {
+		t.Fatalf("reload() of not changed file = %v, %v", reloaded, err)
+	}
+
+	// corrupted file, previous database is used
+	writeDB(t, path, []byte("corrupted"), modTime)
+	modTime = modTime.Add(time.Second)
+
+	if reloaded, err := r.reload(); reloaded || err == nil {
+		t.Fatalf("reload() of corrupted file = %v, %v", reloaded, err)
+	}
+
+	if got := lookupCountry(r); got != "RU" {
+		t.Fatalf("got country %q after failed reload, want RU", got)
+	}
+
+	copyDB("test-data/geoip2-asn.mmdb")
+
+	if reloaded, err := r.reload(); !reloaded || err != nil {
+		t.Fatalf("reload() of new file = %v, %v", reloaded, err)
+	}
+
+	var rec asnRecord
+
+	err = r.Lookup(net.ParseIP("51.38.1.2"), &rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Number != 16276 {
+		t.Errorf("got ASN %d from reloaded database, want 16276", rec.Number)
+	}
+}
+
+func writeDB(t *testing.T, path string, b []byte, modTime time.Time) {
+	t.Helper()
+
+	// database is replaced by rename as update tools do
+	tmp := path + ".tmp"
+
+	err := ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chtimes(tmp, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
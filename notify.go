@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// fileNotifier wait for changes of log file
+type fileNotifier interface {
+	// Wait block until file is probably changed or context is done
+	Wait(ctx context.Context)
+	Close() error
+}
+
+// pollNotifier just sleep, used when there is no better way to watch file
+type pollNotifier struct {
+	delay time.Duration
+}
+
+func newPollNotifier() *pollNotifier {
+	return &pollNotifier{
+		delay: checkDelay,
+	}
+}
+
+func (n *pollNotifier) Wait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(n.delay):
+	}
+}
+
+func (n *pollNotifier) Close() error {
+	return nil
+}
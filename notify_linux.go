@@ -0,0 +1,206 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	// rotation and truncation are also visible via inotify, but log is
+	// checked time to time in case some event is missed
+	inotifyFallbackDelay = time.Second * 5
+
+	inotifyDirMask = syscall.IN_MODIFY | syscall.IN_CREATE | syscall.IN_MOVED_TO |
+		syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_ATTRIB
+)
+
+var (
+	inotifyDirsMu = &sync.Mutex{}
+	// watched directories by path, logs of same directory share inotify
+	// instance, so glob with many files does not hit limit of instances
+	inotifyDirs = map[string]*inotifyDir{}
+)
+
+// inotifyDir watch directory and wake up notifiers of changed files
+type inotifyDir struct {
+	f    *os.File
+	path string
+
+	mu *sync.Mutex
+	// channels of notifiers by file name
+	notifiers map[string][]chan struct{}
+}
+
+// inotifyNotifier wake up when log is written, created or moved
+type inotifyNotifier struct {
+	dir  *inotifyDir
+	name string
+	c    chan struct{}
+}
+
+func newFileNotifier(path string) fileNotifier {
+	n, err := newInotifyNotifier(path)
+	if err != nil {
+		log.Printf("cannot use inotify for %s, fallback to polling: %v", path, err)
+		return newPollNotifier()
+	}
+
+	return n
+}
+
+func newInotifyNotifier(path string) (*inotifyNotifier, error) {
+	dirPath, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("cannot get directory of %s: %w", path, err)
+	}
+
+	inotifyDirsMu.Lock()
+	defer inotifyDirsMu.Unlock()
+
+	dir, ok := inotifyDirs[dirPath]
+	if !ok {
+		dir, err = newInotifyDir(dirPath)
+		if err != nil {
+			return nil, err
+		}
+
+		inotifyDirs[dirPath] = dir
+	}
+
+	n := &inotifyNotifier{
+		dir:  dir,
+		name: filepath.Base(path),
+		c:    make(chan struct{}, 1),
+	}
+
+	dir.mu.Lock()
+	dir.notifiers[n.name] = append(dir.notifiers[n.name], n.c)
+	dir.mu.Unlock()
+
+	return n, nil
+}
+
+func newInotifyDir(path string) (*inotifyDir, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify init: %w", err)
+	}
+
+	_, err = syscall.InotifyAddWatch(fd, path, inotifyDirMask)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("inotify add watch: %w", err)
+	}
+
+	// non blocking fd is handled by runtime poller, so Close unblock Read
+	dir := &inotifyDir{
+		f:         os.NewFile(uintptr(fd), "inotify"),
+		path:      path,
+		mu:        &sync.Mutex{},
+		notifiers: map[string][]chan struct{}{},
+	}
+
+	go dir.read()
+
+	return dir, nil
+}
+
+func (dir *inotifyDir) read() {
+	buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*16)
+
+	for {
+		count, err := dir.f.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= count; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			offset = nameEnd
+
+			if nameEnd > count {
+				break
+			}
+
+			// name is padded with zero bytes
+			name := string(buf[nameStart:nameEnd])
+			for i := 0; i < len(name); i++ {
+				if name[i] == 0 {
+					name = name[:i]
+					break
+				}
+			}
+
+			dir.notify(name)
+		}
+	}
+}
+
+func (dir *inotifyDir) notify(name string) {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	for _, c := range dir.notifiers[name] {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// remove notifier, it return true if directory is not watched anymore
+func (dir *inotifyDir) remove(name string, c chan struct{}) bool {
+	dir.mu.Lock()
+	defer dir.mu.Unlock()
+
+	var notifiers []chan struct{}
+
+	for _, other := range dir.notifiers[name] {
+		if other != c {
+			notifiers = append(notifiers, other)
+		}
+	}
+
+	if len(notifiers) == 0 {
+		delete(dir.notifiers, name)
+	} else {
+		dir.notifiers[name] = notifiers
+	}
+
+	return len(dir.notifiers) == 0
+}
+
+func (n *inotifyNotifier) Wait(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-n.c:
+	case <-time.After(inotifyFallbackDelay):
+	}
+}
+
+// Close stop watching of directory when last log in it is closed
+func (n *inotifyNotifier) Close() error {
+	inotifyDirsMu.Lock()
+	defer inotifyDirsMu.Unlock()
+
+	if !n.dir.remove(n.name, n.c) {
+		return nil
+	}
+
+	delete(inotifyDirs, n.dir.path)
+
+	return n.dir.f.Close()
+}
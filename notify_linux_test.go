@@ -0,0 +1,104 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_inotifyNotifier_Wait(t *testing.T) {
+	dir, err := ioutil.TempDir("", "botassasin_notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	appendLog(t, path, "")
+
+	n, err := newInotifyNotifier(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	// write to other file in same directory must not wake up
+	go func() {
+		_ = ioutil.WriteFile(filepath.Join(dir, "other.log"), []byte("1.1.1.1 /other\n"), 0600)
+		time.Sleep(time.Millisecond * 100)
+		_ = ioutil.WriteFile(path, []byte("1.1.1.1 /first\n"), 0600)
+	}()
+
+	startedAt := time.Now()
+	n.Wait(context.Background())
+	waited := time.Since(startedAt)
+
+	if waited < time.Millisecond*100 {
+		t.Errorf("woke up after %s by write to other file", waited)
+	}
+
+	if waited > inotifyFallbackDelay/2 {
+		t.Errorf("woke up after %s, write was not noticed", waited)
+	}
+}
+
+func Test_newInotifyNotifier_sharedDir(t *testing.T) {
+	dir := t.TempDir()
+
+	first := filepath.Join(dir, "first.log")
+	second := filepath.Join(dir, "second.log")
+
+	n1, err := newInotifyNotifier(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n2, err := newInotifyNotifier(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n1.dir != n2.dir {
+		t.Error("logs of same directory use different inotify instances")
+	}
+
+	appendLog(t, second, "1.1.1.1 /second\n")
+
+	select {
+	case <-n2.c:
+	case <-time.After(time.Second):
+		t.Error("write to second log is not noticed")
+	}
+
+	select {
+	case <-n1.c:
+		t.Error("first log woke up by write to second log")
+	default:
+	}
+
+	n1.Close()
+
+	appendLog(t, second, "1.1.1.1 /second\n")
+
+	select {
+	case <-n2.c:
+	case <-time.After(time.Second):
+		t.Error("write is not noticed after other log of directory is closed")
+	}
+
+	n2.Close()
+
+	inotifyDirsMu.Lock()
+	_, watched := inotifyDirs[n1.dir.path]
+	inotifyDirsMu.Unlock()
+
+	if watched {
+		t.Error("directory is watched after all logs are closed")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func newFileNotifier(path string) fileNotifier {
+	return newPollNotifier()
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const reloadPath = "/-/reload"
+
+// keys of config applied by reload, other keys require restart
+var reloadableConfigKeys = map[string]bool{
+	"debug":             true,
+	"checkers":          true,
+	"block_action":      true,
+	"unblock_action":    true,
+	"blocklog":          true,
+	"blocklog_template": true,
+}
+
+// pipeline part of appcore built from config, it is replaced as whole on
+// config reload
+type pipeline struct {
+	c       *chain
+	act     *action
+	unblock *action
+	log     *logPrinter
+}
+
+// newPipelineFromConfig create pipeline, checkers with not changed config
+// are taken from old pipeline, old can be nil
+func newPipelineFromConfig(cfg config, reportFn reportCheckerWorkTime, old *pipeline) (*pipeline, error) {
+	var oldChain *chain
+	if old != nil {
+		oldChain = old.c
+	}
+
+	cn, err := newChainFromConfig(cfg, reportFn, oldChain)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create chain: %w", err)
+	}
+
+	act, err := newAction(cfg.BlockAction.params)
+	if err != nil {
+		cn.closeExcept(oldChain)
+		return nil, fmt.Errorf("cannot create action: %w", err)
+	}
+
+	unblock, err := newAction(cfg.UnblockAction.params)
+	if err != nil {
+		cn.closeExcept(oldChain)
+		return nil, fmt.Errorf("cannot create unblock action: %w", err)
+	}
+
+	lp, err := newLogPrinter(cfg.Blocklog, cfg.BlocklogTemplate)
+	if err != nil {
+		cn.closeExcept(oldChain)
+		return nil, fmt.Errorf("cannot create log printer: %w", err)
+	}
+
+	return &pipeline{
+		c:       cn,
+		act:     act,
+		unblock: unblock,
+		log:     lp,
+	}, nil
+}
+
+func (p *pipeline) Close() error {
+	return p.closeExcept(nil)
+}
+
+// closeExcept close pipeline replaced by next, checkers reused by next
+// pipeline are kept
+func (p *pipeline) closeExcept(next *pipeline) error {
+	var nextChain *chain
+	if next != nil {
+		nextChain = next.c
+	}
+
+	return firstErr(p.c.closeExcept(nextChain), p.log.Close())
+}
+
+// configReloader re-read config and replace pipeline of appcore, on any
+// error old pipeline is kept
+type configReloader struct {
+	path     string
+	reportFn reportCheckerWorkTime
+	core     *appcore
+
+	mu  *sync.Mutex
+	cfg config
+}
+
+func newConfigReloader(path string, cfg config, core *appcore, reportFn reportCheckerWorkTime) *configReloader {
+	return &configReloader{
+		path:     path,
+		reportFn: reportFn,
+		core:     core,
+		mu:       &sync.Mutex{},
+		cfg:      cfg,
+	}
+}
+
+// Reload return list of changed config keys, only reloadable keys are
+// applied, others are reported as changed until restart
+func (r *configReloader) Reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := loadConfigFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := configDiff(r.cfg, cfg)
+
+	applied := applyReloadable(r.cfg, cfg)
+	if reflect.DeepEqual(applied, r.cfg) {
+		return changed, nil
+	}
+
+	current := r.core.current()
+
+	// changed checkers load state saved by checkers they replace
+	err = current.c.SaveState()
+	if err != nil {
+		log.Printf("cannot save state before reload: %v", err)
+	}
+
+	p, err := newPipelineFromConfig(applied, r.reportFn, current)
+	if err != nil {
+		return nil, err
+	}
+
+	old := r.core.swap(p)
+
+	added, removed, reused := checkersDiff(old.c, p.c)
+	if len(added) > 0 || len(removed) > 0 {
+		log.Printf("checkers added: [%s], removed: [%s], reused: [%s]", strings.Join(added, ", "), strings.Join(removed, ", "), strings.Join(reused, ", "))
+	}
+
+	err = old.closeExcept(p)
+	if err != nil {
+		log.Printf("cannot close old pipeline: %v", err)
+	}
+
+	log.EnableDebug(applied.Debug)
+
+	r.cfg = applied
+
+	return changed, nil
+}
+
+func (r *configReloader) reloadAndLog(reason string) error {
+	log.Printf("reload config %s (%s)", r.path, reason)
+
+	changed, err := r.Reload()
+	if err != nil {
+		log.Printf("cannot reload config, old config is kept: %v", err)
+		return err
+	}
+
+	if len(changed) == 0 {
+		log.Printf("config is not changed")
+		return nil
+	}
+
+	var applied, restart []string
+
+	for _, key := range changed {
+		if reloadableConfigKeys[key] {
+			applied = append(applied, key)
+		} else {
+			restart = append(restart, key)
+		}
+	}
+
+	if len(applied) > 0 {
+		log.Printf("config reloaded, changed: %s", strings.Join(applied, ", "))
+	}
+
+	if len(restart) > 0 {
+		log.Printf("changes require restart: %s", strings.Join(restart, ", "))
+	}
+
+	return nil
+}
+
+// watchSignal reload config on SIGHUP until ctx is done
+func (r *configReloader) watchSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reloadAndLog("SIGHUP")
+		}
+	}
+}
+
+// ServeHTTP reload config on POST request, request must have token when it
+// is set in config, otherwise only requests from localhost are accepted
+func (r *configReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !r.authorized(req) {
+		log.Printf("reload request from %s is rejected", req.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	err := r.reloadAndLog("requested by " + req.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
+
+func (r *configReloader) authorized(req *http.Request) bool {
+	r.mu.Lock()
+	token := r.cfg.ReloadToken
+	r.mu.Unlock()
+
+	if token != "" {
+		got := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// applyReloadable return applied config with reloadable keys taken from
+// new config
+func applyReloadable(applied, new config) config {
+	appliedVal := reflect.ValueOf(&applied).Elem()
+	newVal := reflect.ValueOf(new)
+	t := newVal.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if reloadableConfigKeys[configKey(t.Field(i))] {
+			appliedVal.Field(i).Set(newVal.Field(i))
+		}
+	}
+
+	return applied
+}
+
+// configKey return yaml key of config field
+func configKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "" {
+		key = field.Name
+	}
+
+	return key
+}
+
+// configDiff return yaml keys of top level config values which are different
+func configDiff(old, new config) []string {
+	var changed []string
+
+	oldVal := reflect.ValueOf(old)
+	newVal := reflect.ValueOf(new)
+	t := oldVal.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		if reflect.DeepEqual(oldVal.Field(i).Interface(), newVal.Field(i).Interface()) {
+			continue
+		}
+
+		changed = append(changed, configKey(t.Field(i)))
+	}
+
+	return changed
+}
+
+// checkersDiff return checkers of next chain created on reload, checkers of
+// old chain closed by reload and checkers kept with their state, checker is
+// named by kind and position in its chain (ex. rate#2)
+func checkersDiff(old, next *chain) (added, removed, reused []string) {
+	for i, chk := range next.checkers {
+		name := fmt.Sprintf("%s#%d", chk.kind, i+1)
+
+		if old.has(chk) {
+			reused = append(reused, name)
+		} else {
+			added = append(added, name)
+		}
+	}
+
+	for i, chk := range old.checkers {
+		if !next.has(chk) {
+			removed = append(removed, fmt.Sprintf("%s#%d", chk.kind, i+1))
+		}
+	}
+
+	return added, removed, reused
+}
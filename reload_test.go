@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_configDiff(t *testing.T) {
+	base := func() config {
+		return config{
+			LogFormat:   "format",
+			BlockAction: configBlockAction{params: []string{"echo", "{{.ip}}"}},
+			Checkers: []checkerConfig{
+				map[interface{}]interface{}{"kind": "field", "field": "user_agent"},
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		modify func(cfg *config)
+		want   []string
+	}{
+		{
+			name:   "same",
+			modify: func(cfg *config) {},
+			want:   nil,
+		},
+		{
+			name: "action and checkers",
+			modify: func(cfg *config) {
+				cfg.BlockAction.params = []string{"echo", "ban", "{{.ip}}"}
+				cfg.Checkers[0].(map[interface{}]interface{})["field"] = "referer"
+			},
+			want: []string{"checkers", "block_action"},
+		},
+		{
+			name: "restart required",
+			modify: func(cfg *config) {
+				cfg.LogFormat = "other"
+			},
+			want: []string{"log_format"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base()
+			tt.modify(&cfg)
+
+			if got := configDiff(base(), cfg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("configDiff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_configReloader_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+
+	writeConfig := func(content string) {
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reportFn := func(name string, seconds float64) {}
+
+	writeConfig("block_action: [\"echo\", \"{{.ip}}\"]\n")
+
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newPipelineFromConfig(cfg, reportFn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noop := func(string) {}
+	noopMeasure := func(float64) {}
+
+	core := newAppCore(nil, p, ipCacheConfig{}, newBanLedger("", nil, 0), noop, noopMeasure, noopMeasure)
+	r := newConfigReloader(path, cfg, core, reportFn)
+
+	// invalid checker, old pipeline is kept
+	writeConfig("block_action: [\"echo\", \"{{.ip}}\"]\ncheckers:\n  - kind: unknown\n")
+
+	_, err = r.Reload()
+	if err == nil {
+		t.Fatal("Reload() expected error for unknown checker")
+	}
+
+	if core.current() != p {
+		t.Fatal("pipeline replaced by invalid config")
+	}
+
+	writeConfig("block_action: [\"echo\", \"ban\", \"{{.ip}}\"]\n")
+
+	changed, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changed, []string{"block_action"}) {
+		t.Errorf("Reload() changed = %v, want [block_action]", changed)
+	}
+
+	if core.current() == p {
+		t.Fatal("pipeline is not replaced")
+	}
+
+	if got := len(core.current().act.params); got != 3 {
+		t.Errorf("got %d action params, want 3", got)
+	}
+}
+
+func Test_configReloader_Reload_reuse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+
+	writeConfig := func(content string) {
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reportFn := func(name string, seconds float64) {}
+
+	const checkers = "checkers:\n  - kind: rate\n    windows: [{duration: 1m, limit: 100}]\n  - kind: field\n    field_name: user_agent\n    contains: [%s]\n    action: whitelist\n"
+
+	writeConfig("log_format: a\n" + fmt.Sprintf(checkers, "bot"))
+
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newPipelineFromConfig(cfg, reportFn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core := newTestAppCore(p, newBanLedger("", nil, 0))
+	r := newConfigReloader(path, cfg, core, reportFn)
+
+	// rate checker is not changed and keep own counters
+	writeConfig("log_format: b\n" + fmt.Sprintf(checkers, "crawler"))
+
+	changed, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changed, []string{"log_format", "checkers"}) {
+		t.Errorf("Reload() changed = %v, want [log_format checkers]", changed)
+	}
+
+	next := core.current()
+
+	if next.c.checkers[0] != p.c.checkers[0] {
+		t.Error("not changed rate checker is created again")
+	}
+
+	if next.c.checkers[1] == p.c.checkers[1] {
+		t.Error("changed field checker is reused")
+	}
+
+	if next.c.rechecks != p.c.rechecks {
+		t.Error("rechecks channel is replaced")
+	}
+
+	added, removed, reused := checkersDiff(p.c, next.c)
+	if !reflect.DeepEqual(added, []string{"field#2"}) || !reflect.DeepEqual(removed, []string{"field#2"}) || !reflect.DeepEqual(reused, []string{"rate#1"}) {
+		t.Errorf("checkersDiff() = %v, %v, %v, want [field#2], [field#2], [rate#1]", added, removed, reused)
+	}
+
+	// restart only key is not applied and reported again
+	changed, err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(changed, []string{"log_format"}) {
+		t.Errorf("Reload() changed = %v, want [log_format]", changed)
+	}
+
+	if core.current() != next {
+		t.Error("pipeline is replaced without changes of reloadable keys")
+	}
+}
+
+func Test_configReloader_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		remoteAddr string
+		header     string
+		wantStatus int
+	}{
+		{
+			name:       "localhost without token",
+			method:     http.MethodPost,
+			remoteAddr: "127.0.0.1:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "remote without token",
+			method:     http.MethodPost,
+			remoteAddr: "10.0.0.1:1234",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "remote with token",
+			token:      "secret",
+			method:     http.MethodPost,
+			remoteAddr: "10.0.0.1:1234",
+			header:     "Bearer secret",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "localhost with wrong token",
+			token:      "secret",
+			method:     http.MethodPost,
+			remoteAddr: "127.0.0.1:1234",
+			header:     "Bearer other",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "get",
+			method:     http.MethodGet,
+			remoteAddr: "127.0.0.1:1234",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yml")
+
+			err := ioutil.WriteFile(path, []byte("reload_token: "+tt.token+"\n"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := loadConfigFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			core := newTestAppCore(newTestPipeline(t), newBanLedger("", nil, 0))
+			r := newConfigReloader(path, cfg, core, func(name string, seconds float64) {})
+
+			req := httptest.NewRequest(tt.method, reloadPath, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_configReloader_Reload_saveState(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yml")
+	cachePath := filepath.Join(dir, "rdns.txt")
+
+	writeConfig := func(ttl string) {
+		content := fmt.Sprintf("checkers:\n  - kind: reverse_dns\n    rules:\n      - field: user_agent\n        field_contains: [clientbot]\n        domain_suffixes: [unittesting.org]\n        resolver: 127.0.0.1:1\n    cache:\n      path: %s\n      verified_ttl: %s\n", cachePath, ttl)
+
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reportFn := func(name string, seconds float64) {}
+
+	writeConfig("1h")
+
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newPipelineFromConfig(cfg, reportFn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	core := newTestAppCore(p, newBanLedger("", nil, 0))
+	r := newConfigReloader(path, cfg, core, reportFn)
+
+	// result is only in memory of old checker
+	old := p.c.checkers[0].checker.(*reverseDNSChecker)
+	old.cache.addKey("1.2.3.4@unittesting.org", rdnsVerified)
+
+	writeConfig("2h")
+
+	_, err = r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := core.current().c.checkers[0].checker.(*reverseDNSChecker)
+	defer next.Close()
+
+	if next == old {
+		t.Fatal("changed checker is reused")
+	}
+
+	if result, ok := next.cache.lookupKey("1.2.3.4@unittesting.org"); !ok || result != rdnsVerified {
+		t.Errorf("result of old checker is lost, got %q", result)
+	}
+}
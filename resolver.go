@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vasyahuyasa/botassasin/log"
+)
+
+const (
+	dnsPort = "53"
+	dotPort = "853"
+
+	dohScheme = "https://"
+	dotScheme = "tls://"
+	udpScheme = "udp://"
+	tcpScheme = "tcp://"
+
+	dohContentType = "application/dns-message"
+	// max size of DNS message
+	dohMaxResponseSize = 65535
+
+	// resolver is skipped after this number of failures in row
+	resolverMaxFailures = 3
+	// how long failed resolver is skipped
+	resolverBackoff = time.Second * 30
+
+	systemResolverAddr = "system"
+)
+
+// poolResolver resolver with health state
+type poolResolver struct {
+	*net.Resolver
+	addr string
+
+	// failures in row
+	failures      int
+	disabledUntil time.Time
+}
+
+// resolverPool thread safe round robin over resolvers, failing resolvers
+// are skipped for resolverBackoff
+type resolverPool struct {
+	mu *sync.Mutex
+	// next index in pool
+	next int
+
+	resolvers []*poolResolver
+	now       func() time.Time
+}
+
+func makeResolverPoolFromConfig(resolversCfg resolverListConfig) (*resolverPool, error) {
+	if resolversCfg.len() == 0 {
+		return newDefaultResolverPool(), nil
+	}
+
+	var resolvers []*poolResolver
+
+	for _, addr := range resolversCfg.addrs {
+		r, err := newResolver(addr, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resolvers = append(resolvers, &poolResolver{
+			Resolver: r,
+			addr:     addr,
+		})
+	}
+
+	return newResolverPool(resolvers), nil
+}
+
+// newResolver create resolver by address, supported forms:
+//
+//	1.1.1.1, 1.1.1.1:53, [2606:4700:4700::1111]:53, udp://1.1.1.1, tcp://1.1.1.1
+//	tls://9.9.9.9:853 (DNS-over-TLS)
+//	https://1.1.1.1/dns-query (DNS-over-HTTPS)
+//
+// nil tlsConfig means default settings
+func newResolver(addr string, tlsConfig *tls.Config) (*net.Resolver, error) {
+	var dial func(ctx context.Context, network, address string) (net.Conn, error)
+
+	switch {
+	case strings.HasPrefix(addr, dohScheme):
+		dial = dohDialer(addr, tlsConfig)
+	case strings.HasPrefix(addr, dotScheme):
+		dial = dotDialer(withDefaultPort(strings.TrimPrefix(addr, dotScheme), dotPort), tlsConfig)
+	case strings.HasPrefix(addr, udpScheme):
+		dial = plainDialer(withDefaultPort(strings.TrimPrefix(addr, udpScheme), dnsPort), "udp")
+	case strings.HasPrefix(addr, tcpScheme):
+		dial = plainDialer(withDefaultPort(strings.TrimPrefix(addr, tcpScheme), dnsPort), "tcp")
+	case strings.Contains(addr, "://"):
+		return nil, fmt.Errorf("unknow resolver scheme %q", addr)
+	default:
+		dial = plainDialer(withDefaultPort(addr, dnsPort), "")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial:     dial,
+	}, nil
+}
+
+// withDefaultPort add port to host if it is missing, IPv6 address
+// can be with or without brackets
+func withDefaultPort(addr string, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// plainDialer dial resolver with network requested by net.Resolver or
+// forced network if it is not empty
+func plainDialer(addr string, forceNetwork string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		d := net.Dialer{
+			Timeout: dnsDialerTimeout,
+		}
+
+		if forceNetwork != "" {
+			return d.DialContext(ctx, forceNetwork, addr)
+		}
+
+		switch network {
+		case "udp", "udp4", "udp6":
+			return d.DialContext(ctx, "udp", addr)
+		case "tcp", "tcp4", "tcp6":
+			return d.DialContext(ctx, "tcp", addr)
+		default:
+			return nil, fmt.Errorf("unknow network %q", network)
+		}
+	}
+}
+
+// dotDialer connection is not net.PacketConn so net.Resolver use TCP framing
+func dotDialer(addr string, tlsConfig *tls.Config) func(ctx context.Context, network, address string) (net.Conn, error) {
+	d := &tls.Dialer{
+		NetDialer: &net.Dialer{
+			Timeout: dnsDialerTimeout,
+		},
+		Config: tlsConfig,
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+}
+
+func dohDialer(url string, tlsConfig *tls.Config) func(ctx context.Context, network, address string) (net.Conn, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   tlsConfig,
+			ForceAttemptHTTP2: true,
+			Proxy:             http.ProxyFromEnvironment,
+		},
+		Timeout: resolverLookupTimeout,
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		return &dohConn{
+			ctx:    ctx,
+			url:    url,
+			client: client,
+		}, nil
+	}
+}
+
+// dohConn emulate TCP DNS connection, every written message is sent
+// as HTTP POST request (RFC 8484) and response is returned on read
+type dohConn struct {
+	ctx    context.Context
+	url    string
+	client *http.Client
+
+	wbuf bytes.Buffer
+	rbuf bytes.Buffer
+}
+
+var _ net.Conn = &dohConn{}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	return c.wbuf.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		err := c.roundTrip()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return c.rbuf.Read(b)
+}
+
+func (c *dohConn) roundTrip() error {
+	msg := c.wbuf.Bytes()
+	if len(msg) < 2 {
+		return io.EOF
+	}
+
+	size := int(binary.BigEndian.Uint16(msg))
+	if len(msg) < 2+size {
+		return fmt.Errorf("incomplete DNS message")
+	}
+
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(msg[2:2+size]))
+	if err != nil {
+		return fmt.Errorf("cannot create DoH request: %w", err)
+	}
+
+	c.wbuf.Next(2 + size)
+
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot send DoH request: %w", err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("DoH server %s response status %s", c.url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxResponseSize))
+	if err != nil {
+		return fmt.Errorf("cannot read DoH response: %w", err)
+	}
+
+	var prefix [2]byte
+	binary.BigEndian.PutUint16(prefix[:], uint16(len(body)))
+
+	c.rbuf.Write(prefix[:])
+	c.rbuf.Write(body)
+
+	return nil
+}
+
+func (c *dohConn) Close() error {
+	return nil
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.url)
+}
+
+// deadlines are handled by context of dial
+func (c *dohConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type dohAddr string
+
+func (a dohAddr) Network() string {
+	return "https"
+}
+
+func (a dohAddr) String() string {
+	return string(a)
+}
+
+func newResolverPool(resolvers []*poolResolver) *resolverPool {
+	if len(resolvers) == 0 {
+		log.Fatalf("resolvers list must contain at last one resolver")
+	}
+
+	return &resolverPool{
+		mu:        &sync.Mutex{},
+		resolvers: resolvers,
+		now:       time.Now,
+	}
+}
+
+func newDefaultResolverPool() *resolverPool {
+	return newResolverPool([]*poolResolver{
+		{
+			Resolver: &net.Resolver{},
+			addr:     systemResolverAddr,
+		},
+	})
+}
+
+// get return next healthy resolver, if all resolvers failed they are
+// used in turn anyway
+func (pool *resolverPool) get() *poolResolver {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	now := pool.now()
+	n := len(pool.resolvers)
+
+	for i := 0; i < n; i++ {
+		idx := (pool.next + i) % n
+		r := pool.resolvers[idx]
+
+		if !now.Before(r.disabledUntil) {
+			pool.next = (idx + 1) % n
+			return r
+		}
+	}
+
+	r := pool.resolvers[pool.next]
+	pool.next = (pool.next + 1) % n
+
+	return r
+}
+
+// report result of lookup by resolver
+func (pool *resolverPool) report(r *poolResolver, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if !resolverFailed(err) {
+		r.failures = 0
+		return
+	}
+
+	r.failures++
+
+	if r.failures >= resolverMaxFailures {
+		r.failures = 0
+		r.disabledUntil = pool.now().Add(resolverBackoff)
+
+		log.Printf("resolver %s is skipped for %s after %d failures: %v", r.addr, resolverBackoff, resolverMaxFailures, err)
+	}
+}
+
+// resolverFailed not found name is valid answer of resolver
+func resolverFailed(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	dnsErr := &net.DNSError{}
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// dnsForwarder send DNS message to mock server over UDP
+func dnsForwarder(t *testing.T, addr string) func(msg []byte) ([]byte, error) {
+	return func(msg []byte) ([]byte, error) {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		defer conn.Close()
+
+		_, err = conn.Write(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 65535)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+}
+
+func newDoHStub(t *testing.T, forward func([]byte) ([]byte, error)) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		msg, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp, err := forward(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(resp)
+	}))
+}
+
+func newDoTStub(t *testing.T, certs []tls.Certificate, forward func([]byte) ([]byte, error)) net.Listener {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				for {
+					var size uint16
+
+					err := binary.Read(conn, binary.BigEndian, &size)
+					if err != nil {
+						return
+					}
+
+					msg := make([]byte, size)
+
+					_, err = io.ReadFull(conn, msg)
+					if err != nil {
+						return
+					}
+
+					resp, err := forward(msg)
+					if err != nil {
+						return
+					}
+
+					binary.Write(conn, binary.BigEndian, uint16(len(resp)))
+					conn.Write(resp)
+				}
+			}()
+		}
+	}()
+
+	return ln
+}
+
+func Test_newResolver(t *testing.T) {
+	createDNSServer, closeDNS := dnsMockCreator(t)
+	defer closeDNS()
+
+	mockAddr := createDNSServer(dnsTestZone)
+	forward := dnsForwarder(t, mockAddr)
+
+	doh := newDoHStub(t, forward)
+	defer doh.Close()
+
+	dot := newDoTStub(t, doh.TLS.Certificates, forward)
+	defer dot.Close()
+
+	// trust certificate of stub servers
+	tlsConfig := doh.Client().Transport.(*http.Transport).TLSClientConfig
+
+	tests := []struct {
+		name string
+		addr string
+	}{
+		{
+			name: "plain",
+			addr: mockAddr,
+		},
+		{
+			name: "udp",
+			addr: "udp://" + mockAddr,
+		},
+		{
+			name: "DNS-over-HTTPS",
+			addr: doh.URL + "/dns-query",
+		},
+		{
+			name: "DNS-over-TLS",
+			addr: "tls://" + dot.Addr().String(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := newResolver(tt.addr, tlsConfig)
+			if err != nil {
+				t.Fatalf("newResolver() error = %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), resolverLookupTimeout)
+			defer cancel()
+
+			names, err := r.LookupAddr(ctx, "1.2.3.4")
+			if err != nil {
+				t.Fatalf("LookupAddr() error = %v", err)
+			}
+
+			if len(names) != 1 || names[0] != "bot.unittesting.org." {
+				t.Fatalf("LookupAddr() = %v, want [bot.unittesting.org.]", names)
+			}
+
+			ips, err := r.LookupIPAddr(ctx, "bot.unittesting.org")
+			if err != nil {
+				t.Fatalf("LookupIPAddr() error = %v", err)
+			}
+
+			if len(ips) != 1 || !ips[0].IP.Equal(net.IPv4(1, 2, 3, 4)) {
+				t.Fatalf("LookupIPAddr() = %v, want [1.2.3.4]", ips)
+			}
+
+			_, err = r.LookupAddr(ctx, "9.9.9.9")
+			if resolverFailed(err) {
+				t.Fatalf("LookupAddr() of unknown IP error = %v, want not found", err)
+			}
+		})
+	}
+}
+
+func Test_newResolver_unknownScheme(t *testing.T) {
+	_, err := newResolver("quic://1.1.1.1", nil)
+	if err == nil {
+		t.Fatal("newResolver() expected error")
+	}
+}
+
+func Test_withDefaultPort(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"1.1.1.1", "1.1.1.1:53"},
+		{"1.1.1.1:5353", "1.1.1.1:5353"},
+		{"2606:4700:4700::1111", "[2606:4700:4700::1111]:53"},
+		{"[2606:4700:4700::1111]", "[2606:4700:4700::1111]:53"},
+		{"[2606:4700:4700::1111]:5353", "[2606:4700:4700::1111]:5353"},
+		{"dns.google", "dns.google:53"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := withDefaultPort(tt.addr, dnsPort); got != tt.want {
+				t.Errorf("withDefaultPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_resolverPool_get(t *testing.T) {
+	a := &poolResolver{addr: "a"}
+	b := &poolResolver{addr: "b"}
+
+	now := time.Now()
+
+	pool := newResolverPool([]*poolResolver{a, b})
+	pool.now = func() time.Time {
+		return now
+	}
+
+	order := func(n int) string {
+		var s string
+		for i := 0; i < n; i++ {
+			s += pool.get().addr
+		}
+		return s
+	}
+
+	if got := order(4); got != "abab" {
+		t.Fatalf("get() order = %s, want abab", got)
+	}
+
+	// single resolver is used every time
+	single := newResolverPool([]*poolResolver{a})
+	for i := 0; i < 3; i++ {
+		if got := single.get(); got != a {
+			t.Fatalf("get() of single resolver = %s, want a", got.addr)
+		}
+	}
+
+	failure := errors.New("timeout")
+	notFound := &net.DNSError{Err: "no such host", IsNotFound: true}
+
+	// not found answers are not failures
+	for i := 0; i < resolverMaxFailures; i++ {
+		pool.report(a, notFound)
+	}
+
+	if got := order(2); got != "ab" {
+		t.Fatalf("get() order = %s, want ab", got)
+	}
+
+	for i := 0; i < resolverMaxFailures; i++ {
+		pool.report(a, failure)
+	}
+
+	if got := order(3); got != "bbb" {
+		t.Fatalf("get() order with failed resolver = %s, want bbb", got)
+	}
+
+	// all resolvers failed, used in turn
+	for i := 0; i < resolverMaxFailures; i++ {
+		pool.report(b, failure)
+	}
+
+	if got := order(2); got != "ab" && got != "ba" {
+		t.Fatalf("get() order with all failed resolvers = %s", got)
+	}
+
+	now = now.Add(resolverBackoff)
+
+	pool.report(b, nil)
+
+	if got := order(2); got != "ab" && got != "ba" {
+		t.Fatalf("get() order after backoff = %s", got)
+	}
+
+	if b.failures != 0 {
+		t.Fatalf("failures after success = %d, want 0", b.failures)
+	}
+}
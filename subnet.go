@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// cidrField subnet of banned IP, when it is not set by checker it is IP
+// with full prefix (ex. 1.2.3.4/32)
+const cidrField = "cidr"
+
+// hostCIDR return IP as subnet with single address
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+
+	return ip.String() + "/128"
+}
+
+// subnetOf return subnet of IP with prefix length, zero prefix means whole
+// address space
+func subnetOf(ip net.IP, prefix4, prefix6 int) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4.Mask(net.CIDRMask(prefix4, 32)), Mask: net.CIDRMask(prefix4, 32)}
+	}
+
+	return &net.IPNet{IP: ip.Mask(net.CIDRMask(prefix6, 128)), Mask: net.CIDRMask(prefix6, 128)}
+}
+
+// banTarget return banned subnet set by checker or IP of line
+func banTarget(l *logLine) string {
+	if cidr, ok := l.Get(cidrField); ok && cidr != "" {
+		return cidr
+	}
+
+	return l.IP().String()
+}
+
+// banTargetLine make line for action on IP or subnet from ban ledger
+func banTargetLine(target string) (logLine, error) {
+	l := logLine{fields: map[string]string{}}
+
+	if !strings.Contains(target, "/") {
+		l.ip = net.ParseIP(target)
+		if l.ip == nil {
+			return logLine{}, fmt.Errorf("cannot parse IP %q", target)
+		}
+
+		return l, nil
+	}
+
+	ip, _, err := net.ParseCIDR(target)
+	if err != nil {
+		return logLine{}, fmt.Errorf("cannot parse subnet %q: %w", target, err)
+	}
+
+	l.ip = ip
+	l.fields[cidrField] = target
+
+	return l, nil
+}
+
+type prefixLen struct {
+	ones int
+	bits int
+}
+
+// subnetIndex keep prefix lengths of banned subnets, IP is in banned subnet
+// when one of its subnets with these lengths is in block cache
+type subnetIndex struct {
+	mu   *sync.Mutex
+	lens map[prefixLen]int
+}
+
+func newSubnetIndex() *subnetIndex {
+	return &subnetIndex{
+		mu:   &sync.Mutex{},
+		lens: map[prefixLen]int{},
+	}
+}
+
+// add remember prefix length of banned target, IPs are ignored
+func (idx *subnetIndex) add(target string) {
+	l, ok := targetPrefixLen(target)
+	if !ok {
+		return
+	}
+
+	idx.mu.Lock()
+	idx.lens[l]++
+	idx.mu.Unlock()
+}
+
+func (idx *subnetIndex) remove(target string) {
+	l, ok := targetPrefixLen(target)
+	if !ok {
+		return
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.lens[l]--
+	if idx.lens[l] <= 0 {
+		delete(idx.lens, l)
+	}
+}
+
+// lookup return banned subnet of IP, contains check subnet key in block cache
+func (idx *subnetIndex) lookup(ip net.IP, contains func(key string) bool) (string, bool) {
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+
+	idx.mu.Lock()
+	var lens []prefixLen
+	for l := range idx.lens {
+		if l.bits == bits {
+			lens = append(lens, l)
+		}
+	}
+	idx.mu.Unlock()
+
+	for _, l := range lens {
+		key := subnetOf(ip, l.ones, l.ones).String()
+		if contains(key) {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+func targetPrefixLen(target string) (prefixLen, bool) {
+	if !strings.Contains(target, "/") {
+		return prefixLen{}, false
+	}
+
+	_, ipnet, err := net.ParseCIDR(target)
+	if err != nil {
+		return prefixLen{}, false
+	}
+
+	ones, bits := ipnet.Mask.Size()
+
+	return prefixLen{ones: ones, bits: bits}, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_banTargetLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		wantIP   net.IP
+		wantCIDR string
+	}{
+		{
+			name:     "IPv4",
+			target:   "1.2.3.4",
+			wantIP:   net.ParseIP("1.2.3.4"),
+			wantCIDR: "1.2.3.4/32",
+		},
+		{
+			name:     "IPv4 subnet",
+			target:   "1.2.3.0/24",
+			wantIP:   net.ParseIP("1.2.3.0"),
+			wantCIDR: "1.2.3.0/24",
+		},
+		{
+			name:     "IPv6",
+			target:   "2001:db8::1",
+			wantIP:   net.ParseIP("2001:db8::1"),
+			wantCIDR: "2001:db8::1/128",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := banTargetLine(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !l.IP().Equal(tt.wantIP) {
+				t.Errorf("banTargetLine() ip = %s, want %s", l.IP(), tt.wantIP)
+			}
+
+			act, err := newAction([]string{"echo", "{{.cidr}}"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, params, err := act.formatCmdTpl(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if params[0] != tt.wantCIDR {
+				t.Errorf("got cidr param %q, want %q", params[0], tt.wantCIDR)
+			}
+		})
+	}
+}
+
+func Test_subnetIndex_lookup(t *testing.T) {
+	banned := map[string]bool{
+		"10.1.0.0/16":    true,
+		"192.168.1.0/24": true,
+		"2001:db8::/32":  true,
+		"172.16.0.1":     true,
+	}
+
+	idx := newSubnetIndex()
+	for target := range banned {
+		idx.add(target)
+	}
+
+	contains := func(key string) bool {
+		return banned[key]
+	}
+
+	tests := []struct {
+		ip         string
+		wantSubnet string
+		wantOk     bool
+	}{
+		{ip: "10.1.2.3", wantSubnet: "10.1.0.0/16", wantOk: true},
+		{ip: "192.168.1.200", wantSubnet: "192.168.1.0/24", wantOk: true},
+		{ip: "192.168.2.1", wantOk: false},
+		{ip: "2001:db8:1::1", wantSubnet: "2001:db8::/32", wantOk: true},
+		{ip: "2001:db9::1", wantOk: false},
+		// single IP targets are not subnets
+		{ip: "172.16.0.1", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			subnet, ok := idx.lookup(net.ParseIP(tt.ip), contains)
+			if ok != tt.wantOk || subnet != tt.wantSubnet {
+				t.Errorf("subnetIndex.lookup() = %q, %v, want %q, %v", subnet, ok, tt.wantSubnet, tt.wantOk)
+			}
+		})
+	}
+
+	idx.remove("10.1.0.0/16")
+	delete(banned, "10.1.0.0/16")
+
+	if _, ok := idx.lookup(net.ParseIP("10.1.2.3"), contains); ok {
+		t.Error("subnetIndex.lookup() found removed subnet")
+	}
+}
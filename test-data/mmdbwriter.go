@@ -0,0 +1,284 @@
+//go:build ignore
+// +build ignore
+
+// mmdbwriter generate small MaxMind DB files for tests, it support only
+// types used by GeoLite2 databases. ASN and City databases are written by
+// it, Country database by mmdbwroter.pl. Output is deterministic, so
+// committed files are reproduced byte to byte.
+//
+//	cd test-data && go run mmdbwriter.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// uint16, uint32 and uint64 values are written with own mmdb types
+type (
+	u16 uint16
+	u32 uint32
+	u64 uint64
+)
+
+type network struct {
+	cidr string
+	data map[string]interface{}
+}
+
+type database struct {
+	databaseType string
+	networks     []network
+}
+
+var databases = map[string]database{
+	"geoip2-asn.mmdb": {
+		databaseType: "GeoLite2-ASN",
+		networks: []network{
+			{"51.38.0.0/16", asn(16276, "OVH SAS")},
+			{"95.216.0.0/16", asn(24940, "Hetzner Online GmbH")},
+			{"167.99.0.0/16", asn(14061, "DIGITALOCEAN-ASN")},
+			{"66.249.64.0/19", asn(15169, "GOOGLE")},
+			{"2a01:4f8::/32", asn(24940, "Hetzner Online GmbH")},
+		},
+	},
+	"geoip2-city.mmdb": {
+		databaseType: "GeoIP2-City",
+		networks: []network{
+			{"95.173.136.72/32", city("EU", "RU", "MOW", "Moscow", 20)},
+			{"192.229.221.103/32", city("EU", "FR", "IDF", "Paris", 50)},
+			{"128.1.51.210/32", city("AS", "CN", "", "", 1000)},
+			{"2001:db8::/32", city("NA", "US", "CA", "Los Angeles", 100)},
+		},
+	},
+}
+
+func asn(number uint32, org string) map[string]interface{} {
+	return map[string]interface{}{
+		"autonomous_system_number":       u32(number),
+		"autonomous_system_organization": org,
+	}
+}
+
+func city(continent, country, subdivision, name string, accuracy uint16) map[string]interface{} {
+	rec := map[string]interface{}{
+		"continent": map[string]interface{}{"code": continent},
+		"country":   map[string]interface{}{"iso_code": country},
+		"location":  map[string]interface{}{"accuracy_radius": u16(accuracy)},
+	}
+
+	if subdivision != "" {
+		rec["subdivisions"] = []interface{}{
+			map[string]interface{}{"iso_code": subdivision},
+		}
+	}
+
+	if name != "" {
+		rec["city"] = map[string]interface{}{
+			"names": map[string]interface{}{"en": name, "ru": name},
+		}
+	}
+
+	return rec
+}
+
+type node struct {
+	children [2]*node
+	// data offset of leaf, -1 for not leaf
+	data [2]int
+}
+
+func newNode() *node {
+	return &node{data: [2]int{-1, -1}}
+}
+
+func main() {
+	for name, db := range databases {
+		err := os.WriteFile(name, build(db.databaseType, db.networks), 0644)
+		if err != nil {
+			log.Fatalf("cannot write %s: %v", name, err)
+		}
+
+		log.Printf("%s: %d networks", name, len(db.networks))
+	}
+}
+
+func build(databaseType string, networks []network) []byte {
+	root := newNode()
+	data := &bytes.Buffer{}
+
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		ones, bits := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+
+		// IPv4 networks are placed in ::/96
+		if bits == 32 {
+			ones += 96
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+		}
+
+		offset := data.Len()
+		encode(data, n.data)
+
+		cur := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+
+			if i == ones-1 {
+				cur.data[bit] = offset
+				break
+			}
+
+			if cur.children[bit] == nil {
+				cur.children[bit] = newNode()
+			}
+
+			cur = cur.children[bit]
+		}
+	}
+
+	// number nodes in breadth first order
+	nodes := []*node{root}
+	ids := map[*node]int{root: 0}
+
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				ids[child] = len(nodes)
+				nodes = append(nodes, child)
+			}
+		}
+	}
+
+	nodeCount := len(nodes)
+	out := &bytes.Buffer{}
+
+	for _, n := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := nodeCount
+
+			switch {
+			case n.children[bit] != nil:
+				record = ids[n.children[bit]]
+			case n.data[bit] >= 0:
+				record = nodeCount + 16 + n.data[bit]
+			}
+
+			// 24 bit record
+			out.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+
+	encode(out, map[string]interface{}{
+		"node_count":                  u32(nodeCount),
+		"record_size":                 u16(24),
+		"ip_version":                  u16(6),
+		"database_type":               databaseType,
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": u16(2),
+		"binary_format_minor_version": u16(0),
+		"build_epoch":                 u64(time.Date(2021, 6, 24, 0, 0, 0, 0, time.UTC).Unix()),
+		"description":                 map[string]interface{}{"en": "botassasin test database"},
+	})
+
+	return out.Bytes()
+}
+
+func encode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		writeControl(buf, 2, len(v))
+		buf.WriteString(v)
+
+	case float64:
+		writeControl(buf, 3, 8)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+
+	case u16:
+		writeUint(buf, 5, uint64(v))
+
+	case u32:
+		writeUint(buf, 6, uint64(v))
+
+	case u64:
+		writeUint(buf, 9, uint64(v))
+
+	case map[string]interface{}:
+		writeControl(buf, 7, len(v))
+
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, v[k])
+		}
+
+	case []interface{}:
+		writeControl(buf, 11, len(v))
+
+		for _, item := range v {
+			encode(buf, item)
+		}
+
+	default:
+		log.Fatalf("unsupported type %T", v)
+	}
+}
+
+func writeUint(buf *bytes.Buffer, typ int, v uint64) {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+
+	writeControl(buf, typ, len(b))
+	buf.Write(b)
+}
+
+func writeControl(buf *bytes.Buffer, typ int, size int) {
+	var ctrl byte
+	var ext []byte
+
+	if typ > 7 {
+		ext = []byte{byte(typ - 7)}
+	} else {
+		ctrl = byte(typ << 5)
+	}
+
+	var sizeBytes []byte
+
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 29+256:
+		ctrl |= 29
+		sizeBytes = []byte{byte(size - 29)}
+	default:
+		size -= 285
+		ctrl |= 30
+		sizeBytes = []byte{byte(size >> 8), byte(size)}
+	}
+
+	buf.WriteByte(ctrl)
+	buf.Write(ext)
+	buf.Write(sizeBytes)
+}